@@ -0,0 +1,151 @@
+package lsmtree
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+var (
+	// ErrBadBloomFilter is returned when a serialized bloom filter is too short to be decoded.
+	ErrBadBloomFilter = errors.New("bad bloom filter")
+)
+
+type (
+	// BloomHash is used to hash keys for a bloom filter. Every probe into the filter is derived
+	// from the single 64-bit hash of the key, so the hash should be well distributed across all
+	// 64 bits.
+	BloomHash func(key []byte) uint64
+
+	// bloomFilter is used to quickly check if a key might be in a set of keys. If Contains returns
+	// false then the key is definitely not in the set, but if it returns true then the key might
+	// be in the set. The false positive rate and the hash are chosen by whatever builds the
+	// filter. They are not in Options yet because nothing in the database builds a filter until
+	// there are heap files to build them for.
+	bloomFilter struct {
+		bits   []byte
+		probes int
+		hash   BloomHash
+	}
+)
+
+// DefaultBloomHash is the 64-bit fnv-1a hash of the key. This is used when no BloomHash is
+// provided.
+func DefaultBloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return h.Sum64()
+}
+
+// newBloomFilter will create an empty bloom filter that is sized to hold the number of keys
+// provided with the target false positive rate. The number of probes per key is derived from the
+// false positive rate. If hash is nil then DefaultBloomHash is used.
+func newBloomFilter(keys int, falsePositiveRate float64, hash BloomHash) *bloomFilter {
+	if keys < 1 {
+		keys = 1
+	}
+
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+
+	// The optimal number of bits per key is -ln(p) / ln(2)^2 and the optimal number of probes is
+	// bits per key * ln(2), which works out to -log2(p).
+	bitsPerKey := -math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)
+	probes := int(math.Ceil(-math.Log2(falsePositiveRate)))
+	if probes > 30 {
+		probes = 30
+	}
+
+	bits := int(math.Ceil(bitsPerKey * float64(keys)))
+	if bits < 64 {
+		bits = 64
+	}
+
+	return newBloomFilterFromBits(make([]byte, (bits+7)/8), probes, hash)
+}
+
+// newBloomFilterFromBits returns a bloom filter that uses the bits and the number of probes
+// provided.
+func newBloomFilterFromBits(bits []byte, probes int, hash BloomHash) *bloomFilter {
+	if hash == nil {
+		hash = DefaultBloomHash
+	}
+
+	return &bloomFilter{
+		bits:   bits,
+		probes: probes,
+		hash:   hash,
+	}
+}
+
+// Add will add the key to the filter.
+func (b *bloomFilter) Add(key []byte) {
+	b.each(key, func(bit uint64) bool {
+		b.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+// Contains will return false if the key was definitely never added to the filter. If it returns
+// true then the key might have been added.
+func (b *bloomFilter) Contains(key []byte) bool {
+	return b.each(key, func(bit uint64) bool {
+		return b.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+// each will call fn with every bit that the key maps to. The bits are derived from a single hash
+// using double hashing, the first bit is the low 32 bits of the hash and each bit after that is
+// offset by the high 32 bits of the hash. If fn returns false then each will stop and return
+// false.
+func (b *bloomFilter) each(key []byte, fn func(bit uint64) bool) bool {
+	size := uint64(len(b.bits)) * 8
+	if size == 0 {
+		return false
+	}
+
+	h := mixBloomHash(b.hash(key))
+	h1, h2 := h&math.MaxUint32, h>>32
+	for i := uint64(0); i < uint64(b.probes); i++ {
+		if !fn((h1 + i*h2) % size) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mixBloomHash is the 64-bit finalizer from murmur3. Hashes like fnv do not spread small changes in
+// the key across all 64 bits, which makes the two halves used for double hashing correlated. The
+// finalizer is a bijection so it never makes a good hash worse.
+func mixBloomHash(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Encode returns the serialized form of the filter. This is the bits of the filter followed by a
+// single byte with the number of probes. The hash function is not included, the same hash must be
+// provided when the filter is decoded.
+func (b *bloomFilter) Encode() []byte {
+	data := make([]byte, len(b.bits)+1)
+	copy(data, b.bits)
+	data[len(b.bits)] = byte(b.probes)
+	return data
+}
+
+// decodeBloomFilter will read a filter that was serialized with Encode. If hash is nil then
+// DefaultBloomHash is used.
+func decodeBloomFilter(data []byte, hash BloomHash) (*bloomFilter, error) {
+	if len(data) < 2 {
+		return nil, ErrBadBloomFilter
+	}
+
+	bits := make([]byte, len(data)-1)
+	copy(bits, data)
+	return newBloomFilterFromBits(bits, int(data[len(data)-1]), hash), nil
+}
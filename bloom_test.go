@@ -0,0 +1,69 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	numberOfKeys := 10000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	// A deliberately simple hash to make sure that the filter is correct with any hash.
+	weakHash := func(key []byte) uint64 {
+		h := uint64(1469598103934665603)
+		for _, b := range key {
+			h = h*31 + uint64(b)
+		}
+		return h * 0x9e3779b97f4a7c15
+	}
+
+	for _, falsePositiveRate := range []float64{0.1, 0.01, 0.001} {
+		for name, hash := range map[string]BloomHash{"default": nil, "weak": weakHash} {
+			t.Run(fmt.Sprintf("%s %v", name, falsePositiveRate), func(t *testing.T) {
+				filter := newBloomFilter(numberOfKeys, falsePositiveRate, hash)
+				for i := 0; i < numberOfKeys; i++ {
+					filter.Add(key(i))
+				}
+
+				// There must never be a false negative.
+				for i := 0; i < numberOfKeys; i++ {
+					assert.True(t, filter.Contains(key(i)), "false negative for %s", key(i))
+				}
+
+				falsePositives := 0
+				for i := numberOfKeys; i < numberOfKeys*2; i++ {
+					if filter.Contains(key(i)) {
+						falsePositives++
+					}
+				}
+
+				rate := float64(falsePositives) / float64(numberOfKeys)
+				t.Logf("bits per key %.1f probes %d false positive rate %.4f",
+					float64(len(filter.bits)*8)/float64(numberOfKeys), filter.probes, rate)
+				assert.Less(t, rate, falsePositiveRate*2)
+			})
+		}
+	}
+
+	t.Run("encode", func(t *testing.T) {
+		filter := newBloomFilter(100, 0.01, nil)
+		for i := 0; i < 100; i++ {
+			filter.Add(key(i))
+		}
+
+		decoded, err := decodeBloomFilter(filter.Encode(), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, filter.bits, decoded.bits)
+		assert.Equal(t, filter.probes, decoded.probes)
+		for i := 0; i < 100; i++ {
+			assert.True(t, decoded.Contains(key(i)))
+		}
+
+		_, err = decodeBloomFilter([]byte{1}, nil)
+		assert.Equal(t, ErrBadBloomFilter, err)
+	})
+}
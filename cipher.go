@@ -0,0 +1,53 @@
+package lsmtree
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrDecrypting is returned when encrypted data read from a file could not be decrypted. This
+	// happens when the data is corrupt or the wrong key was provided.
+	ErrDecrypting = errors.New("could not decrypt data")
+)
+
+// cipherOverhead returns the number of bytes that sealing a block with the cipher adds to it. This
+// is the nonce that is stored in front of every block plus the cipher's own overhead. If the cipher
+// is nil then there is no overhead.
+func cipherOverhead(c cipher.AEAD) int {
+	if c == nil {
+		return 0
+	}
+
+	return c.NonceSize() + c.Overhead()
+}
+
+// sealBlock will encrypt the plaintext with a new random nonce and append the nonce followed by
+// the ciphertext to dst.
+func sealBlock(c cipher.AEAD, dst, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return c.Seal(append(dst, nonce...), nonce, plaintext, additionalData), nil
+}
+
+// openBlock will decrypt a block that was sealed with sealBlock and append the plaintext to dst.
+// To decrypt the block in place dst should be the empty slice at the start of the ciphertext,
+// directly after the nonce. If the block cannot be decrypted then ErrDecrypting is returned.
+func openBlock(c cipher.AEAD, dst, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < cipherOverhead(c) {
+		return nil, ErrDecrypting
+	}
+
+	nonceSize := c.NonceSize()
+	plaintext, err := c.Open(dst, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrDecrypting
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,173 @@
+package lsmtree
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func newTestCipher(t *testing.T, key string) cipher.AEAD {
+	block, err := aes.NewCipher([]byte(fmt.Sprintf("%-32s", key)))
+	assert.NoError(t, err)
+
+	aead, err := cipher.NewGCM(block)
+	assert.NoError(t, err)
+
+	return aead
+}
+
+func TestCipher_Values(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		manager.cipher = newTestCipher(t, "secret")
+
+		type location struct {
+			fileId, offset uint64
+			value          []byte
+		}
+		locations := make([]location, 0)
+		for i := 0; i < 10; i++ {
+			value := []byte(fmt.Sprintf("plaintext value %d", i))
+			fileId, offset, _, err := manager.Write(nil, value)
+			assert.NoError(t, err)
+			locations = append(locations, location{fileId, offset, value})
+		}
+
+		for _, l := range locations {
+			value, err := manager.Read(nil, l.fileId, l.offset, uint64(len(l.value)))
+			assert.NoError(t, err)
+			assert.Equal(t, l.value, value)
+		}
+		assert.NoError(t, manager.Close())
+
+		// None of the values should be readable on the disk.
+		raw, err := ioutil.ReadFile(path.Join(dir, getValueFileName(1)))
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(raw, []byte("plaintext")))
+
+		// The entries should still be iterable once the file is reopened.
+		file, err := openValueFile(dir, 1, false)
+		assert.NoError(t, err)
+		file.Cipher = newTestCipher(t, "secret")
+		file.Offset = uint64(len(raw))
+		i := 0
+		err = file.Iterate(func(offset, size uint64, value []byte) error {
+			assert.Equal(t, locations[i].offset, offset)
+			assert.Equal(t, locations[i].value, value)
+			i++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, len(locations), i)
+
+		// The wrong key should not be able to read the values.
+		file.Cipher = newTestCipher(t, "wrong")
+		_, err = file.Read(locations[0].offset, uint64(len(locations[0].value)))
+		assert.True(t, errors.Is(err, ErrDecrypting))
+		assert.NoError(t, file.Close())
+	})
+}
+
+func TestCipher_WAL(t *testing.T) {
+	newTransaction := func(transactionId uint64) walTransaction {
+		return walTransaction{
+			TransactionId: transactionId,
+			Timestamp:     transactionId * 10,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte(fmt.Sprintf("plaintext key %d", transactionId)),
+					Value: []byte(fmt.Sprintf("plaintext value %d", transactionId)),
+				},
+			},
+		}
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		aead := newTestCipher(t, "secret")
+		segment, err := openWalSegmentWithCipher(dir, 1, 1024, true, aead)
+		assert.NoError(t, err)
+
+		for i := uint64(1); i <= 3; i++ {
+			assert.NoError(t, segment.Append(newTransaction(i)))
+		}
+		before := segment.Space
+
+		// The fixed fields are not encrypted so they can still be updated in place.
+		ok, err := segment.UpdateTransaction(2, 5, 6)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.NoError(t, segment.Sync())
+		assert.NoError(t, segment.Close())
+
+		raw, err := ioutil.ReadFile(path.Join(dir, getWalSegmentFileName(1)))
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(raw, []byte("plaintext")))
+
+		segment, err = openWalSegmentWithCipher(dir, 1, 1024, true, aead)
+		assert.NoError(t, err)
+		assert.Equal(t, before, segment.Space)
+
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 3)
+		for i, transaction := range transactions {
+			expected := newTransaction(uint64(i + 1))
+			if expected.TransactionId == 2 {
+				expected.HeapId, expected.ValueFileId = 5, 6
+			}
+			assert.Equal(t, expected, transaction)
+		}
+		assert.NoError(t, segment.Close())
+
+		// The wrong key should not be able to open the segment, and the segment must not be
+		// truncated because of it.
+		_, err = openWalSegmentWithCipher(dir, 1, 1024, false, newTestCipher(t, "wrong"))
+		assert.True(t, errors.Is(err, ErrDecrypting))
+
+		unchanged, err := ioutil.ReadFile(path.Join(dir, getWalSegmentFileName(1)))
+		assert.NoError(t, err)
+		assert.Equal(t, raw, unchanged)
+	})
+
+	t.Run("standalone", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultWALOptions()
+		options.Directory = dir
+		options.Cipher = newTestCipher(t, "secret")
+
+		wal, err := OpenWAL(options)
+		assert.NoError(t, err)
+		_, err = wal.Append(WALChange{Key: []byte("plaintext key"), Value: []byte("plaintext")})
+		assert.NoError(t, err)
+		assert.NoError(t, wal.Close())
+
+		wal, err = OpenWAL(options)
+		assert.NoError(t, err)
+		changes := make([]WALChange, 0)
+		err = wal.ReadFrom(0, func(txn WALTransaction) error {
+			changes = append(changes, txn.Changes...)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []WALChange{
+			{Key: []byte("plaintext key"), Value: []byte("plaintext")},
+		}, changes)
+		assert.NoError(t, wal.Close())
+	})
+}
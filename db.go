@@ -1,7 +1,39 @@
 package lsmtree
 
 import (
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDBClosed is returned when the database is used after it has been closed, or when a write
+	// was still waiting to be processed when the database was closed.
+	ErrDBClosed = errors.New("database is closed")
+
+	// ErrClockRegression is returned when a transaction is committed with RejectClockRegressions
+	// set and the Clock returns a time before the timestamp of the last transaction.
+	ErrClockRegression = errors.New("clock went backwards")
+
+	// ErrDuplicateKey is returned in StrictMode when a transaction changes the same key more than
+	// once.
+	ErrDuplicateKey = errors.New("key is changed more than once in the transaction")
+
+	// ErrNilValue is returned in StrictMode when a transaction sets a key to a nil value. An empty
+	// value must be set with an empty slice, and a key is removed with a delete.
+	ErrNilValue = errors.New("key is set to a nil value")
+
+	// ErrBadKeySize is returned in StrictMode when a transaction changes a key that is empty or
+	// larger than MaxKeySize.
+	ErrBadKeySize = errors.New("key size is out of bounds")
+
+	// ErrUnknownChangeType is returned in StrictMode when a transaction has a change that is not a
+	// set or a delete.
+	ErrUnknownChangeType = errors.New("unknown change type")
 )
 
 // Options is used to configure how the database will behave.
@@ -14,55 +46,349 @@ type Options struct {
 	// Default is 8kb.
 	MaxWALSegmentSize uint64
 
+	// WALPreallocSize (in bytes) is the size that new WAL segment files are created with. As a
+	// segment fills up it will be grown until it reaches MaxWALSegmentSize, at which point a new
+	// segment will be started. If this is 0 then segments are created at MaxWALSegmentSize.
+	// Default is 0.
+	WALPreallocSize uint64
+
+	// ShouldRotateWAL is an optional hook that is called after every transaction is written to the
+	// WAL with the number of bytes used in the current segment and the segment's total size. If it
+	// returns true then the current segment is finished and a new segment is started for the next
+	// transaction. This can be used to rotate on custom criteria, such as the age of the segment.
+	// Segments are always rotated when they reach MaxWALSegmentSize regardless of this hook.
+	// Default is nil.
+	ShouldRotateWAL func(used, capacity int64) bool
+
 	// MaxValueChunkSize (in byteS) is the largest a single Value file will grow to before a new
 	// file is created. This does not include the last value appended to the value file.
 	// Default is 32kb.
 	MaxValueChunkSize uint64
 
-	// WALDirectory is the folder where WAL segment files will be stored.
-	// Default is db/wal.
+	// Directory is the folder that the database is stored in. WAL segment files are stored in a
+	// wal folder and heap and value files are stored in a data folder within it, unless the
+	// WALDirectory or the DataDirectory are set.
+	// Default is db.
+	Directory string
+
+	// WALDirectory is the folder where WAL segment files will be stored. If this is blank then
+	// Directory/wal is used.
+	// Default is blank.
 	WALDirectory string
 
-	// DataDirectory is the folder where heap and value files will be stored.
-	// Default is db/data.
+	// DataDirectory is the folder where heap and value files will be stored. If this is blank then
+	// Directory/data is used.
+	// Default is blank.
 	DataDirectory string
 
+	// ValueDirectory is the folder where value files will be stored instead of the DataDirectory.
+	// Values are rewritten far more often than heap files, so this can be used to keep them on
+	// faster or larger storage. If this is blank then value files are stored in the DataDirectory.
+	// Default is blank.
+	ValueDirectory string
+
 	// Number of pending writes that can be queued up concurrently before transaction commits will
 	// be blocked.
 	PendingWritesBuffer int
+
+	// MaxOpenValueFiles is the maximum number of value file handles that will be kept open at
+	// once. When more value files than this are needed the least recently used file will be closed
+	// and reopened the next time it is read. The value file currently being written to is never
+	// closed. If this is 0 then there is no limit.
+	// Default is 64.
+	MaxOpenValueFiles int
+
+	// DisableDirectorySync will skip syncing the WAL and data directories after a new file has
+	// been created in them. Without the directory sync a new file might not survive a crash even
+	// if its contents were synced. This should only be disabled for filesystems that are not
+	// durable anyway, such as tmpfs.
+	// Default is false.
+	DisableDirectorySync bool
+
+	// Comparator is used to order keys everywhere keys are sorted. Once a database has been
+	// created it must always be opened with the same Comparator. (see ComparatorName)
+	// Default is DefaultComparator (bytewise).
+	Comparator Comparator
+
+	// ComparatorName identifies the Comparator. The name is recorded when the database is created
+	// and opening it again with a different name returns ErrFormatMismatch. This must be changed
+	// whenever the Comparator is changed, it cannot be empty when a Comparator is provided.
+	// Default is DefaultComparatorName.
+	ComparatorName string
+
+	// Cipher is used to encrypt the data written to WAL segments and value files. Each value and
+	// the changes of each transaction are sealed with their own random nonce which is stored in
+	// front of them. The key is never written to the disk, the same key must be provided every
+	// time the database is opened. If this is nil then nothing is encrypted.
+	// Default is nil.
+	Cipher cipher.AEAD
+
+	// IgnoreChecksumErrors will return values whose checksum does not match instead of failing to
+	// read them. The error ErrValueChecksumIgnored is returned along with the value so the caller
+	// knows that the value might be corrupt, and corrupt values are skipped while iterating. A
+	// corrupt value is returned as it was stored, without being decoded by the ValueCodec. This
+	// is only meant for salvaging data from a damaged database.
+	// Default is false.
+	IgnoreChecksumErrors bool
+
+	// DisableChecksums will store values in the value files without a checksum, and values will
+	// not be validated when they are read. This is faster, but corrupt values will be returned as
+	// if nothing was wrong. This should only be used if the values are already validated some
+	// other way. This cannot be changed once the database has been created, opening it with a
+	// different setting returns ErrFormatMismatch.
+	// Default is false.
+	DisableChecksums bool
+
+	// CommitBatchWindow is how long the background writer will wait for more transactions to be
+	// committed after it receives one, so that they can all be written to the WAL and synced to
+	// the disk with a single fsync. A batch is committed once the window has passed or once
+	// PendingWritesBuffer transactions have been collected, whichever happens first. A commit is
+	// durable once its result has been returned. If this is 0 then each transaction is written to
+	// the WAL and synced on its own as soon as it is received. If a sync of the WAL fails then the
+	// commits waiting for it fail with that error, and so does every commit after it until the
+	// database is reopened and the WAL is recovered.
+	// Default is 0.
+	CommitBatchWindow time.Duration
+
+	// CoalesceWrites will drop a transaction from a batch of commits when the transaction after it
+	// changes the same key, so that only the last change is written to the WAL. Only transactions
+	// with a single change are coalesced, and only with the transaction directly after them, so
+	// the order of changes to different keys and the boundaries of larger transactions are kept.
+	// A dropped transaction is not given a transaction id and is not delivered to subscribers, its
+	// commit returns the same result as the commit of the transaction that replaced it. This only
+	// has an effect when CommitBatchWindow is greater than 0.
+	// Default is false.
+	CoalesceWrites bool
+
+	// ShardDepth is the number of levels of subdirectories that value files are spread across
+	// within the ValueDirectory. Each level is named by one byte of the file id, starting above the
+	// lowest byte, so up to 256 consecutive files are stored in the same directory. For example
+	// with a ShardDepth of 1 value file 0x1234 is stored in ValueDirectory/12. This keeps any
+	// single directory from holding thousands of files. If this is 0 then all files are stored
+	// directly in the ValueDirectory. This cannot be changed once value files have been written.
+	// Default is 0.
+	ShardDepth int
+
+	// ValueCodec is used to transform values before they are stored in the value files and after
+	// they are read back, such as to compress them. Once a database has been created it must
+	// always be opened with a ValueCodec of the same name, otherwise ErrFormatMismatch is
+	// returned. If this is nil then values are stored as is.
+	// Default is nil.
+	ValueCodec ValueCodec
+
+	// Clock is used to timestamp every transaction as it is committed. Timestamps are used for
+	// MVCC so they must always increase. If the clock does not move forward, or goes backwards
+	// (such as from an NTP adjustment), then the transaction is given a timestamp 1 nanosecond
+	// after the last one, unless RejectClockRegressions is set.
+	// Default is time.Now.
+	Clock func() time.Time
+
+	// RejectClockRegressions will fail a commit with ErrClockRegression rather than correcting its
+	// timestamp when the Clock returns a time before the last transaction's timestamp. If the Clock
+	// returns the same time as the last transaction then the timestamp is still corrected.
+	// Default is false.
+	RejectClockRegressions bool
+
+	// StrictMode will validate every transaction before it is committed, and fail the commit with
+	// a descriptive error if the transaction changes a key more than once (ErrDuplicateKey), sets
+	// a key to a nil value (ErrNilValue), changes a key that is empty or larger than MaxKeySize
+	// (ErrBadKeySize) or has a change that is not a set or a delete (ErrUnknownChangeType).
+	// Without StrictMode the last change to a key in a transaction is the one that is kept, and a
+	// nil value is stored as an empty value.
+	// Default is false.
+	StrictMode bool
+
+	// MaxKeySize (in bytes) is the largest key that can be changed when StrictMode is set. If this
+	// is 0 then keys can be any size.
+	// Default is 0.
+	MaxKeySize int
+
+	// StartFileId is the lowest id that will be given to a new WAL segment or value file. Ids
+	// continue from the highest existing file if it is above this. Giving databases disjoint id
+	// ranges means their files can later be merged into one database without any colliding.
+	// Default is 0, which starts ids at 1.
+	StartFileId uint64
+
+	// Logger is used to report what the database is doing in the background, such as WAL segments
+	// being rotated or recovered and files being flushed.
+	// Default is nil, which does not log anything.
+	Logger Logger
+
+	// WriteRetry is the policy used to retry writes to WAL segments and value files that fail with
+	// a transient error.
+	// Default is 3 attempts starting with a 1ms backoff.
+	WriteRetry RetryPolicy
 }
 
+type (
+	// commitRequest is sent to the background writer to have a transaction written to the WAL. If
+	// Result is not nil then the result of the write will be sent to it. The transaction is given
+	// its id by the background writer when it is appended.
+	commitRequest struct {
+		Transaction walTransaction
+		Result      chan error
+	}
+
+	// drainRequest is sent to the background writer as a barrier. Because the background writer
+	// processes the writeChannel in order, once it responds to the drainRequest every write that
+	// was queued before it has been processed.
+	drainRequest chan error
+)
+
 // DB is the root object for the database. You can open/create your DB by calling Open().
 type DB struct {
-	wal    *walManager
-	values *valueManager
+	wal     *walManager
+	values  *valueManager
+	compare Comparator
+	logger  Logger
+
+	// commitBatchWindow is how long commits are collected before they are synced. (see Options)
+	commitBatchWindow time.Duration
+
+	// coalesceWrites will drop transactions from a batch that the next transaction replaces.
+	// (see Options)
+	coalesceWrites bool
+
+	// lastTransactionId is the id of the last transaction that was appended to the WAL. This is
+	// only used by the background writer, transaction ids are assigned in the same order that the
+	// transactions are appended so the WAL never has ids out of order or gaps between them.
+	lastTransactionId uint64
+
+	// lastTimestamp is the timestamp of the last transaction that was appended to the WAL. This is
+	// only used by the background writer so that timestamps are always increasing. (see Clock)
+	lastTimestamp          uint64
+	clock                  func() time.Time
+	rejectClockRegressions bool
+
+	// strictMode and maxKeySize are used to validate transactions before they are committed.
+	// (see Options.StrictMode)
+	strictMode bool
+	maxKeySize int
 
 	writeChannel     chan interface{}
 	stopWriteChannel chan chan error
+
+	// closeLock is held for reading by anything that uses the database, and for writing while the
+	// database is being closed. Once closed is true nothing else can be sent to the writeChannel.
+	closeLock sync.RWMutex
+	closed    bool
+
+	// subscribers receive every transaction after it has been written to the WAL. (see Subscribe)
+	subscribersLock sync.Mutex
+	subscribers     map[*subscriber]struct{}
 }
 
 // Open will open or create the database using the provided configuration.
 func Open(options Options) (*DB, error) {
+	db, err := open(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the background writer to accept transaction commits.
+	go db.backgroundWriter()
+
+	return db, nil
+}
+
+// open will open or create the database without starting the background writer. Nothing sent to
+// the writer is handled until step is called.
+func open(options Options) (*DB, error) {
 	// TODO (elliotcourant) Add options validation.
 
+	// The WAL and the data are stored within the database's directory unless their directories
+	// have been provided explicitly.
+	if options.WALDirectory == "" {
+		options.WALDirectory = path.Join(options.Directory, "wal")
+	}
+
+	if options.DataDirectory == "" {
+		options.DataDirectory = path.Join(options.Directory, "data")
+	}
+
+	if options.ValueDirectory == "" {
+		options.ValueDirectory = options.DataDirectory
+	}
+
+	if options.Logger == nil {
+		options.Logger = noopLogger{}
+	}
+
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+
+	// The data on the disk must be read the same way it was written.
+	format, err := newDBFormat(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkFormat(options.DataDirectory, format); err != nil {
+		return nil, err
+	}
+
 	// Try to setup the WAL manager.
-	wal, err := newWalManager(options.WALDirectory, options.MaxWALSegmentSize)
+	wal, err := newWalManager(
+		options.WALDirectory, options.MaxWALSegmentSize, options.WALPreallocSize, options.WriteRetry,
+		!options.DisableDirectorySync,
+	)
 	if err != nil {
 		return nil, err
 	}
+	wal.skipTo(options.StartFileId)
+	wal.ShouldRotate = options.ShouldRotateWAL
+	wal.Logger = options.Logger
+	wal.Cipher = options.Cipher
+
+	// Try to setup the value manager.
+	values, err := newValueManager(
+		options.ValueDirectory, options.MaxValueChunkSize, options.MaxOpenValueFiles,
+		options.WriteRetry, !options.DisableDirectorySync,
+	)
+	if err != nil {
+		return nil, err
+	}
+	values.skipTo(options.StartFileId)
+	values.cipher = options.Cipher
+	values.ignoreChecksumErrors = options.IgnoreChecksumErrors
+
+	values.disableChecksums = options.DisableChecksums
+	values.shardDepth = options.ShardDepth
+
+	values.codec = options.ValueCodec
+
+	// New transactions continue from the last transaction in the WAL.
+	lastTransaction, _, err := wal.LastTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	compare := options.Comparator
+	if compare == nil {
+		compare = DefaultComparator
+	}
 
 	db := &DB{
-		wal:          wal,
-		values:       nil,
-		writeChannel: make(chan interface{}, options.PendingWritesBuffer),
+		wal:                    wal,
+		values:                 values,
+		compare:                compare,
+		logger:                 options.Logger,
+		commitBatchWindow:      options.CommitBatchWindow,
+		coalesceWrites:         options.CoalesceWrites,
+		lastTransactionId:      lastTransaction.TransactionId,
+		lastTimestamp:          lastTransaction.Timestamp,
+		clock:                  options.Clock,
+		rejectClockRegressions: options.RejectClockRegressions,
+		strictMode:             options.StrictMode,
+		maxKeySize:             options.MaxKeySize,
+		writeChannel:           make(chan interface{}, options.PendingWritesBuffer),
+		subscribers:            map[*subscriber]struct{}{},
 
 		// TODO (elliotcourant) make this channel some sort of cancelFuture object.
 		stopWriteChannel: make(chan chan error, 1), // Make this a single byte for now.
 	}
 
-	// Start the background writer to accept transaction commits.
-	go db.backgroundWriter()
-
 	return db, nil
 }
 
@@ -71,15 +397,34 @@ func DefaultOptions() Options {
 	return Options{
 		MaxWALSegmentSize:   1024 /* 1kb */ * 8,  /* 8kb */
 		MaxValueChunkSize:   1024 /* 1kb */ * 32, /* 32kb */
-		DataDirectory:       "db/data",
-		WALDirectory:        "db/wal",
+		Directory:           "db",
 		PendingWritesBuffer: 8,
+		MaxOpenValueFiles:   64,
+		Comparator:          DefaultComparator,
+		ComparatorName:      DefaultComparatorName,
+		WriteRetry: RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Millisecond,
+			MaxBackoff:  time.Millisecond * 100,
+		},
 	}
 }
 
 // Close will close any open files and stop any background writes. Any writes that have not been
-// returned successfully will not have been written to the database.
+// returned successfully will not have been written to the database, writes that were still waiting
+// to be processed will fail with ErrDBClosed. It is safe to call Close while the database is being
+// used, anything that is called once Close has started will return ErrDBClosed. If the database
+// has already been closed then ErrDBClosed is returned.
 func (db *DB) Close() error {
+	// Wait for anything that is already using the database to finish sending to the background
+	// writer, then make sure nothing else can.
+	db.closeLock.Lock()
+	defer db.closeLock.Unlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+	db.closed = true
+
 	// Create a channel that we can use to wait for the response from the background writer.
 	writeChannelFuture := make(chan error, 0)
 
@@ -93,19 +438,398 @@ func (db *DB) Close() error {
 
 	// TODO (elliotcourant) Add timeout logic here if the background writer takes too long to exit.
 
+	// Nothing else will be committed, so there is nothing left to deliver to subscribers.
+	db.cancelSubscribers()
+
+	// Now that nothing else will be written, close the WAL and all of the value files. The value
+	// files are still closed if the WAL could not be.
+	walErr := db.wal.Close()
+	if err := db.values.Close(); err != nil && walErr == nil {
+		return err
+	}
+
+	return walErr
+}
+
+// Drain will block until every write that was queued before Drain was called has been processed by
+// the background writer. Unlike Close, the database can still be used after Drain returns.
+func (db *DB) Drain() error {
+	barrier := make(drainRequest, 1)
+
+	// The barrier is queued behind any writes that are already pending.
+	if err := db.send(barrier); err != nil {
+		return err
+	}
+
+	return <-barrier
+}
+
+// enqueue will send the transaction to the background writer to be committed. If result is not
+// nil then the result of the commit will be sent to it once the transaction has been written. Any
+// TransactionId set on the transaction is replaced with the next id when it is appended. If the
+// database has been closed then ErrDBClosed is returned and nothing is sent to result. In
+// StrictMode the transaction is validated first, and if it is invalid then the error is returned
+// and nothing is sent to result.
+func (db *DB) enqueue(txn walTransaction, result chan error) error {
+	if db.strictMode {
+		if err := db.validate(txn); err != nil {
+			return err
+		}
+	}
+
+	return db.send(commitRequest{
+		Transaction: txn,
+		Result:      result,
+	})
+}
+
+// validate will check the changes of the transaction for anything that StrictMode does not
+// allow. The error returned describes the first change that is not allowed.
+func (db *DB) validate(txn walTransaction) error {
+	for i, change := range txn.Entries {
+		if len(change.Key) == 0 || (db.maxKeySize > 0 && len(change.Key) > db.maxKeySize) {
+			return fmt.Errorf(
+				"change %d of the transaction has a %d byte key: %w", i, len(change.Key),
+				ErrBadKeySize,
+			)
+		}
+
+		switch change.Type {
+		case walTransactionChangeTypeSet:
+			if change.Value == nil {
+				return fmt.Errorf(
+					"change %d of the transaction: key %q: %w", i, change.Key, ErrNilValue,
+				)
+			}
+
+		case walTransactionChangeTypeDelete:
+			// A delete does not have a value to check.
+
+		default:
+			return fmt.Errorf(
+				"change %d of the transaction has type %d: %w", i, change.Type, ErrUnknownChangeType,
+			)
+		}
+	}
+
+	// Sort the changes by key so that any duplicates are next to each other. The comparator is
+	// used since keys that it considers equal are the same key to the database.
+	changes := make([]int, len(txn.Entries))
+	for i := range changes {
+		changes[i] = i
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return db.compare(txn.Entries[changes[i]].Key, txn.Entries[changes[j]].Key) < 0
+	})
+
+	for i := 1; i < len(changes); i++ {
+		first, second := txn.Entries[changes[i-1]], txn.Entries[changes[i]]
+		if db.compare(first.Key, second.Key) == 0 {
+			return fmt.Errorf(
+				"changes %d and %d of the transaction: key %q: %w", changes[i-1], changes[i],
+				second.Key, ErrDuplicateKey,
+			)
+		}
+	}
+
+	return nil
+}
+
+// send will queue the item for the background writer unless the database has been closed.
+func (db *DB) send(item interface{}) error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+
+	db.writeChannel <- item
+	return nil
+}
+
+// Flush is a durability barrier. Once it returns, the current WAL segment and every value file that
+// has been written to will have been flushed to the disk. It is safe to call Flush while writes are
+// being committed, writes that are committed while Flush is running may or may not be included.
+func (db *DB) Flush() error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+
+	// TODO (elliotcourant) Flush the active memtable to a heap file and record it in the manifest
+	//  once those exist, so that a reopen does not need to replay the WAL.
+	if err := db.wal.Sync(); err != nil {
+		return err
+	}
+
+	if err := db.values.Sync(); err != nil {
+		return err
+	}
+
+	db.logger.Infof("flushed the wal and value files to the disk")
 	return nil
 }
 
+// RotateWAL will sync and close the current WAL segment and start a new one, returning the ID of
+// the new segment. This can be used to cut a segment on demand, such as before taking a backup. It
+// is safe to call RotateWAL while writes are being committed, each transaction will be written
+// entirely to either the old segment or the new one.
+func (db *DB) RotateWAL() (newSegmentId uint64, err error) {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+	if db.closed {
+		return 0, ErrDBClosed
+	}
+
+	// TODO (elliotcourant) Record the new segment in the manifest once the manifest exists.
+	return db.wal.Rotate()
+}
+
+// Files returns every file that belongs to the database, sorted by type and then by id. Every WAL
+// segment is FileStatusUnflushed since nothing is flushed from the WAL to heap files yet, and
+// every value file is FileStatusLive. If the database has been closed then ErrDBClosed is
+// returned.
+func (db *DB) Files() ([]FileInfo, error) {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	// TODO (elliotcourant) List the manifest and heap files and take the status of each file from
+	//  the manifest once it exists.
+	files, err := appendFileInfos(make([]FileInfo, 0), db.wal.Directory, FileTypeWAL)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range files {
+		files[i].Status = FileStatusUnflushed
+	}
+
+	if files, err = appendFileInfos(files, db.values.directory, FileTypeValue); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Type != files[j].Type {
+			return files[i].Type < files[j].Type
+		}
+
+		return files[i].Id < files[j].Id
+	})
+
+	return files, nil
+}
+
 func (db *DB) backgroundWriter() {
+	for db.step() {
+	}
+}
+
+// step will wait for the next item to be sent to the background writer and handle it. It returns
+// false once the writer has been stopped, after which step must not be called again.
+func (db *DB) step() bool {
+	select {
+	case item := <-db.writeChannel:
+		// When commits are batched the item read from the writeChannel after the batch might not
+		// be a commit. It still needs to be handled once the batch has been committed.
+		for item != nil {
+			item = db.handleWrite(item)
+		}
+
+		return true
+
+	case stopResult := <-db.stopWriteChannel:
+		// If we receive anything on the stopWriteChannel then reject anything that is still queued
+		// and stop. Nothing else can be queued once the database is closed.
+		db.rejectPending()
+		stopResult <- nil
+		return false
+	}
+}
+
+// rejectPending will fail every item that is still in the writeChannel with ErrDBClosed. This is
+// called by the background writer when it is stopped so that nothing is left waiting for a result.
+func (db *DB) rejectPending() {
 	for {
 		select {
-		case txn := <-db.writeChannel:
-			fmt.Println(txn)
+		case item := <-db.writeChannel:
+			switch request := item.(type) {
+			case commitRequest:
+				if request.Result != nil {
+					request.Result <- ErrDBClosed
+				}
+
+			case drainRequest:
+				request <- ErrDBClosed
+			}
 
-		case stopResult := <-db.stopWriteChannel:
-			// If we receive anything on the stopWriteChannel then just exit this method.
-			stopResult <- nil
+		default:
 			return
 		}
 	}
 }
+
+// handleWrite will process a single item from the writeChannel. If the item is a commit and commits
+// are being batched then any item that was read from the writeChannel that could not be added to
+// the batch is returned so that it can be handled next.
+func (db *DB) handleWrite(item interface{}) (next interface{}) {
+	switch request := item.(type) {
+	case commitRequest:
+		if db.commitBatchWindow > 0 {
+			return db.commitBatch(request)
+		}
+
+		// Without a window every commit is synced on its own before its result is sent, so that
+		// it is just as durable as a commit in a batch.
+		err := db.append(&request.Transaction)
+		if err == nil {
+			err = db.wal.Sync()
+		}
+
+		if err == nil {
+			db.publish(request.Transaction)
+		}
+
+		if request.Result != nil {
+			request.Result <- err
+		}
+
+	case drainRequest:
+		request <- nil
+
+	default:
+		db.logger.Errorf("background writer received an unknown item: %T", item)
+	}
+
+	return nil
+}
+
+// commitBatch will wait up to the CommitBatchWindow after the first request for more commits to
+// arrive, or until PendingWritesBuffer commits have been collected. Every transaction in the batch
+// is then appended to the WAL, apart from any that are coalesced (see Options.CoalesceWrites), and
+// the WAL is synced once before any result is sent. If something
+// other than a commit is read from the writeChannel then the batch is committed early and that
+// item is returned.
+func (db *DB) commitBatch(first commitRequest) (next interface{}) {
+	batchSize := cap(db.writeChannel)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	batch := make([]commitRequest, 1, batchSize)
+	batch[0] = first
+
+	timer := time.NewTimer(db.commitBatchWindow)
+	defer timer.Stop()
+
+collect:
+	for len(batch) < batchSize {
+		select {
+		case item := <-db.writeChannel:
+			request, ok := item.(commitRequest)
+			if !ok {
+				next = item
+				break collect
+			}
+
+			batch = append(batch, request)
+
+		case <-timer.C:
+			break collect
+		}
+	}
+
+	superseded := make([]bool, len(batch))
+	if db.coalesceWrites {
+		for i := 0; i < len(batch)-1; i++ {
+			superseded[i] = db.supersedes(batch[i+1].Transaction, batch[i].Transaction)
+		}
+	}
+
+	results := make([]error, len(batch))
+	appended := false
+	for i := range batch {
+		if superseded[i] {
+			continue
+		}
+
+		results[i] = db.append(&batch[i].Transaction)
+		appended = appended || results[i] == nil
+	}
+
+	// A single sync makes the whole batch durable. If it fails then none of the transactions that
+	// were appended can be considered committed.
+	if appended {
+		if err := db.wal.Sync(); err != nil {
+			for i := range results {
+				if results[i] == nil {
+					results[i] = err
+				}
+			}
+		}
+	}
+
+	// A transaction that was dropped has the same result as the one that replaced it. Runs of
+	// dropped transactions all take the result of the transaction at the end of the run.
+	for i := len(batch) - 2; i >= 0; i-- {
+		if superseded[i] {
+			results[i] = results[i+1]
+		}
+	}
+
+	for i, request := range batch {
+		if results[i] == nil && !superseded[i] {
+			db.publish(request.Transaction)
+		}
+
+		if request.Result != nil {
+			request.Result <- results[i]
+		}
+	}
+
+	return next
+}
+
+// supersedes returns true if next replaces the only change made by txn, so that txn does not need
+// to be written to the WAL when it is directly followed by next. (see Options.CoalesceWrites)
+func (db *DB) supersedes(next, txn walTransaction) bool {
+	return len(txn.Entries) == 1 && len(next.Entries) == 1 &&
+		db.compare(txn.Entries[0].Key, next.Entries[0].Key) == 0
+}
+
+// append will give the transaction the next transaction id and a timestamp from the clock and
+// write it to the WAL. The id is only used up if the transaction was appended, so a failed append
+// does not leave a gap. If the clock has gone backwards then the timestamp is corrected to be after
+// the last one, or ErrClockRegression is returned if regressions are rejected. This must only be
+// called by the background writer.
+func (db *DB) append(txn *walTransaction) error {
+	// A clock that returns the same time twice has not gone backwards, it just does not have a
+	// fine enough resolution. Only a time before the last timestamp is a regression.
+	timestamp := uint64(db.clock().UnixNano())
+	if timestamp < db.lastTimestamp {
+		if db.rejectClockRegressions {
+			return ErrClockRegression
+		}
+
+		db.logger.Warnf(
+			"clock went backwards by %s, correcting the timestamp",
+			time.Duration(db.lastTimestamp-timestamp),
+		)
+	}
+
+	if timestamp <= db.lastTimestamp {
+		timestamp = db.lastTimestamp + 1
+	}
+
+	txn.TransactionId, txn.Timestamp = db.lastTransactionId+1, timestamp
+	if err := db.wal.Append(*txn); err != nil {
+		return err
+	}
+
+	db.lastTransactionId, db.lastTimestamp = txn.TransactionId, txn.Timestamp
+	return nil
+}
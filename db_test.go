@@ -1,8 +1,19 @@
 package lsmtree
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -21,4 +32,1286 @@ func TestOpen(t *testing.T) {
 		err = db.Close()
 		assert.NoError(t, err)
 	})
+
+	t.Run("single directory", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.Directory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		assert.DirExists(t, path.Join(dir, "wal"))
+		assert.DirExists(t, path.Join(dir, "data"))
+
+		fileId, offset, size, err := db.values.Write(nil, []byte("value one"))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Flush())
+
+		value, err := db.values.Read(nil, fileId, offset, size)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value one"), value)
+
+		err = db.Close()
+		assert.NoError(t, err)
+		assert.FileExists(t, path.Join(dir, "data", getValueFileName(fileId)))
+	})
+
+	t.Run("directory overrides", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.Directory = path.Join(dir, "db")
+		options.WALDirectory = path.Join(dir, "log")
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		assert.DirExists(t, path.Join(dir, "log"))
+		assert.DirExists(t, path.Join(dir, "db", "data"))
+		assert.False(t, getPathExists(path.Join(dir, "db", "wal")))
+
+		err = db.Close()
+		assert.NoError(t, err)
+	})
+
+	t.Run("value directory", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.Directory = path.Join(dir, "db")
+		options.ValueDirectory = path.Join(dir, "values")
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		fileId, offset, size, err := db.values.Write(nil, []byte("value one"))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		assert.FileExists(t, path.Join(dir, "values", getValueFileName(fileId)))
+		assert.False(t, getPathExists(path.Join(dir, "db", "data", getValueFileName(fileId))))
+
+		// The value files should be found in the value directory once the database is reopened.
+		db, err = Open(options)
+		assert.NoError(t, err)
+
+		value, err := db.values.Read(nil, fileId, offset, size)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value one"), value)
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestDB_Flush(t *testing.T) {
+	t.Run("with values written", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		value := []byte("value one")
+		fileId, offset, _, err := db.values.Write(nil, value)
+		assert.NoError(t, err)
+
+		err = db.Flush()
+		assert.NoError(t, err)
+
+		err = db.Close()
+		assert.NoError(t, err)
+
+		// The value should have been flushed to the disk so a fresh value manager can read it.
+		values, err := newValueManager(
+			dir, options.MaxValueChunkSize, options.MaxOpenValueFiles, options.WriteRetry, true,
+		)
+		assert.NoError(t, err)
+		defer values.Close()
+
+		read, err := values.Read(nil, fileId, offset, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, read)
+	})
+}
+
+func TestDB_Drain(t *testing.T) {
+	t.Run("queued writes", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.PendingWritesBuffer = 128
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		numberOfWrites := 100
+		for i := 0; i < numberOfWrites; i++ {
+			db.enqueue(walTransaction{
+				TransactionId: uint64(i + 1),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key"),
+						Value: []byte("value"),
+					},
+				},
+			}, nil)
+		}
+
+		err = db.Drain()
+		assert.NoError(t, err)
+		assert.Empty(t, db.writeChannel)
+
+		err = db.Close()
+		assert.NoError(t, err)
+
+		// Every write that was queued should now be in the WAL.
+		segmentIds, err := getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+
+		transactionId := uint64(1)
+		for _, segmentId := range segmentIds {
+			segment, err := openWalSegment(dir, segmentId, int32(options.MaxWALSegmentSize), false)
+			assert.NoError(t, err)
+
+			transactions, err := segment.GetTransactions()
+			assert.NoError(t, err)
+			for _, transaction := range transactions {
+				assert.Equal(t, transactionId, transaction.TransactionId)
+				transactionId++
+			}
+			assert.NoError(t, segment.Close())
+		}
+		assert.Equal(t, uint64(numberOfWrites+1), transactionId)
+	})
+}
+
+func TestDB_CommitOrder(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	options := DefaultOptions()
+	options.Directory = dir
+	db := newDBForTest(t, options)
+
+	// commit will queue a transaction that sets the key without waiting for it to be handled.
+	commit := func(key string) chan error {
+		result := make(chan error, 1)
+		assert.NoError(t, db.enqueue(walTransaction{
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte(key),
+					Value: []byte("value"),
+				},
+			},
+		}, result))
+		return result
+	}
+
+	first, second := commit("first"), commit("second")
+
+	// Drain blocks until the writer handles it, so it needs to be called from another goroutine.
+	// Nothing can be committed until the writer is stepped.
+	drained := make(chan error, 1)
+	go func() {
+		drained <- db.Drain()
+	}()
+	db.WaitForQueued(3)
+	third := commit("third")
+	assert.False(t, isDone(first))
+
+	assert.True(t, db.Step())
+	assert.True(t, isDone(first))
+	assert.False(t, isDone(second))
+
+	assert.True(t, db.Step())
+	assert.True(t, isDone(second))
+	assert.False(t, isDone(drained))
+
+	assert.True(t, db.Step())
+	assert.NoError(t, <-drained)
+	assert.False(t, isDone(third))
+
+	assert.True(t, db.Step())
+	for _, result := range []chan error{first, second, third} {
+		assert.NoError(t, <-result)
+	}
+
+	itr, err := db.wal.ReadFrom(0)
+	assert.NoError(t, err)
+
+	keys := make([]string, 0, 3)
+	for ; itr.Valid(); itr.Next() {
+		txn := itr.Transaction()
+		assert.Equal(t, uint64(len(keys)+1), txn.TransactionId)
+		keys = append(keys, string(txn.Entries[0].Key))
+	}
+	assert.NoError(t, itr.Err())
+	assert.Equal(t, []string{"first", "second", "third"}, keys)
+
+	assert.NoError(t, db.Close())
+	assert.Equal(t, ErrDBClosed, db.Drain())
+}
+
+func TestDB_Close(t *testing.T) {
+	t.Run("use after close", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.Directory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		assert.Equal(t, ErrDBClosed, db.Close())
+		assert.Equal(t, ErrDBClosed, db.Drain())
+		assert.Equal(t, ErrDBClosed, db.Flush())
+		assert.Equal(t, ErrDBClosed, db.enqueue(walTransaction{TransactionId: 1}, nil))
+
+		_, err = db.RotateWAL()
+		assert.Equal(t, ErrDBClosed, err)
+
+		_, err = db.Subscribe(0, func(walTransaction) error {
+			return nil
+		})
+		assert.Equal(t, ErrDBClosed, err)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		for _, window := range []time.Duration{0, time.Millisecond} {
+			dir, cleanup := NewTempDirectory(t)
+
+			options := DefaultOptions()
+			options.Directory = dir
+			options.CommitBatchWindow = window
+
+			db, err := Open(options)
+			assert.NoError(t, err)
+
+			var transactionId, committed, rejected uint64
+			numberOfWorkers := 16
+			wg := sync.WaitGroup{}
+			wg.Add(numberOfWorkers)
+			for i := 0; i < numberOfWorkers; i++ {
+				go func(worker int) {
+					defer wg.Done()
+
+					result := make(chan error, 1)
+					for j := 0; j < 200; j++ {
+						var err error
+						switch j % 10 {
+						case 0:
+							err = db.Drain()
+						case 1:
+							err = db.Flush()
+						default:
+							if err = db.enqueue(walTransaction{
+								TransactionId: atomic.AddUint64(&transactionId, 1),
+								Entries: []walTransactionChange{
+									{
+										Type:  walTransactionChangeTypeSet,
+										Key:   []byte(fmt.Sprintf("key %d", worker)),
+										Value: []byte("value"),
+									},
+								},
+							}, result); err == nil {
+								err = <-result
+							}
+						}
+
+						switch err {
+						case nil:
+							atomic.AddUint64(&committed, 1)
+						case ErrDBClosed:
+							atomic.AddUint64(&rejected, 1)
+						default:
+							t.Errorf("unexpected error: %v", err)
+							return
+						}
+					}
+				}(i)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			assert.NoError(t, db.Close())
+			wg.Wait()
+
+			assert.Equal(t, uint64(numberOfWorkers*200), committed+rejected)
+			cleanup()
+		}
+	})
+}
+
+func TestDB_TransactionIds(t *testing.T) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		t.Run(fmt.Sprintf("window %s", window), func(t *testing.T) {
+			dir, cleanup := NewTempDirectory(t)
+			defer cleanup()
+
+			options := DefaultOptions()
+			options.Directory = dir
+			options.MaxWALSegmentSize = 1024
+			options.CommitBatchWindow = window
+
+			// commit will write transactions from several goroutines at once.
+			commit := func(db *DB, numberOfWorkers, numberOfWrites int) {
+				wg := sync.WaitGroup{}
+				wg.Add(numberOfWorkers)
+				for i := 0; i < numberOfWorkers; i++ {
+					go func(worker int) {
+						defer wg.Done()
+
+						result := make(chan error, 1)
+						for j := 0; j < numberOfWrites; j++ {
+							assert.NoError(t, db.enqueue(walTransaction{
+								// This should be replaced when the transaction is appended.
+								TransactionId: uint64(worker),
+								Entries: []walTransactionChange{
+									{
+										Type:  walTransactionChangeTypeSet,
+										Key:   []byte(fmt.Sprintf("key %d", worker)),
+										Value: []byte("value"),
+									},
+								},
+							}, result))
+							assert.NoError(t, <-result)
+						}
+					}(i)
+				}
+				wg.Wait()
+			}
+
+			db, err := Open(options)
+			assert.NoError(t, err)
+			commit(db, 8, 25)
+			assert.NoError(t, db.Close())
+
+			// The ids should continue from the WAL once the database is reopened.
+			db, err = Open(options)
+			assert.NoError(t, err)
+			commit(db, 8, 25)
+
+			itr, err := db.wal.ReadFrom(0)
+			assert.NoError(t, err)
+
+			expected := uint64(1)
+			for ; itr.Valid(); itr.Next() {
+				assert.Equal(t, expected, itr.Transaction().TransactionId)
+				expected++
+			}
+			assert.NoError(t, itr.Err())
+			assert.Equal(t, uint64(8*25*2+1), expected)
+			assert.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestDB_Clock(t *testing.T) {
+	// commit will write a single transaction and return the result.
+	commit := func(db *DB) error {
+		result := make(chan error, 1)
+		if err := db.enqueue(walTransaction{
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: []byte("value"),
+				},
+			},
+		}, result); err != nil {
+			return err
+		}
+
+		return <-result
+	}
+
+	// transactions returns every transaction in the WAL.
+	transactions := func(db *DB) []walTransaction {
+		itr, err := db.wal.ReadFrom(0)
+		assert.NoError(t, err)
+
+		txns := make([]walTransaction, 0)
+		for ; itr.Valid(); itr.Next() {
+			txns = append(txns, itr.Transaction())
+		}
+		assert.NoError(t, itr.Err())
+		return txns
+	}
+
+	t.Run("correct", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		now := time.Unix(1000, 0)
+		options := DefaultOptions()
+		options.Directory = dir
+		options.Clock = func() time.Time {
+			return now
+		}
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		assert.NoError(t, commit(db))
+		now = now.Add(-time.Minute)
+		assert.NoError(t, commit(db))
+		assert.NoError(t, commit(db))
+		assert.NoError(t, db.Close())
+
+		// The timestamps should continue from the WAL once the database is reopened, even though
+		// the clock is still behind.
+		db, err = Open(options)
+		assert.NoError(t, err)
+		assert.NoError(t, commit(db))
+
+		txns := transactions(db)
+		assert.Len(t, txns, 4)
+		for i, txn := range txns {
+			assert.Equal(t, uint64(i+1), txn.TransactionId)
+			assert.Equal(t, uint64(time.Unix(1000, 0).UnixNano())+uint64(i), txn.Timestamp)
+		}
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		now := time.Unix(1000, 0)
+		options := DefaultOptions()
+		options.Directory = dir
+		options.RejectClockRegressions = true
+		options.Clock = func() time.Time {
+			return now
+		}
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		assert.NoError(t, commit(db))
+
+		// The same time is not a regression, the timestamp is still corrected.
+		assert.NoError(t, commit(db))
+
+		now = now.Add(-time.Minute)
+		assert.Equal(t, ErrClockRegression, commit(db))
+
+		// The rejected transaction should not use up an id.
+		now = now.Add(2 * time.Minute)
+		assert.NoError(t, commit(db))
+
+		txns := transactions(db)
+		assert.Len(t, txns, 3)
+		assert.Equal(t, []uint64{1, 2, 3}, []uint64{
+			txns[0].TransactionId, txns[1].TransactionId, txns[2].TransactionId,
+		})
+		assert.Equal(t, txns[0].Timestamp+1, txns[1].Timestamp)
+		assert.Equal(t, uint64(now.UnixNano()), txns[2].Timestamp)
+	})
+}
+
+func TestDB_Files(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	options := DefaultOptions()
+	options.Directory = dir
+	options.MaxWALSegmentSize = 1024
+	options.MaxValueChunkSize = 64
+	options.ShardDepth = 1
+
+	db, err := Open(options)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			_, _, _, err := db.values.Write(nil, []byte(fmt.Sprintf("value %d %d", i, j)))
+			assert.NoError(t, err)
+
+			result := make(chan error, 1)
+			assert.NoError(t, db.enqueue(walTransaction{
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key %d %d", i, j)),
+						Value: []byte("value"),
+					},
+				},
+			}, result))
+			assert.NoError(t, <-result)
+		}
+
+		assert.NoError(t, db.Flush())
+		_, err := db.RotateWAL()
+		assert.NoError(t, err)
+	}
+
+	files, err := db.Files()
+	assert.NoError(t, err)
+
+	// Every WAL segment and value file in the directory should be listed exactly once.
+	expected := map[string]int64{}
+	assert.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() != formatFileName {
+			expected[path] = info.Size()
+		}
+		return err
+	}))
+	assert.Len(t, files, len(expected))
+
+	counts := map[FileType]int{}
+	for i, file := range files {
+		size, ok := expected[file.Path]
+		assert.True(t, ok, "unexpected file %s", file.Path)
+		assert.Equal(t, size, file.Size)
+
+		kind, id, ok := parseFileName(filepath.Base(file.Path))
+		assert.True(t, ok)
+		assert.Equal(t, kind, file.Type)
+		assert.Equal(t, id, file.Id)
+
+		switch file.Type {
+		case FileTypeWAL:
+			assert.Equal(t, FileStatusUnflushed, file.Status)
+		case FileTypeValue:
+			assert.Equal(t, FileStatusLive, file.Status)
+		default:
+			t.Errorf("unexpected file type %s", file.Type)
+		}
+		counts[file.Type]++
+
+		if i > 0 {
+			previous := files[i-1]
+			assert.True(t, previous.Type < file.Type ||
+				(previous.Type == file.Type && previous.Id < file.Id))
+		}
+	}
+	// Each rotation starts a new segment straight away, so there is an empty one at the end.
+	assert.Equal(t, 4, counts[FileTypeWAL])
+	assert.Greater(t, counts[FileTypeValue], 1)
+
+	assert.NoError(t, db.Close())
+	_, err = db.Files()
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestDB_Format(t *testing.T) {
+	openAt := func(dir string, change func(options *Options)) error {
+		options := DefaultOptions()
+		options.Directory = dir
+		change(&options)
+
+		db, err := Open(options)
+		if err != nil {
+			return err
+		}
+
+		return db.Close()
+	}
+
+	t.Run("checksums", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		assert.NoError(t, openAt(dir, func(options *Options) {}))
+
+		// The value files were written with checksums, so they cannot be read without them.
+		err := openAt(dir, func(options *Options) {
+			options.DisableChecksums = true
+		})
+		assert.True(t, errors.Is(err, ErrFormatMismatch))
+		assert.NoError(t, openAt(dir, func(options *Options) {}))
+
+		// And the other way around.
+		dir, cleanup = NewTempDirectory(t)
+		defer cleanup()
+
+		disable := func(options *Options) {
+			options.DisableChecksums = true
+		}
+		assert.NoError(t, openAt(dir, disable))
+		assert.True(t, errors.Is(openAt(dir, func(options *Options) {}), ErrFormatMismatch))
+		assert.NoError(t, openAt(dir, disable))
+	})
+
+	t.Run("value codec", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		withCodec := func(codec ValueCodec) func(options *Options) {
+			return func(options *Options) {
+				options.ValueCodec = codec
+			}
+		}
+
+		assert.NoError(t, openAt(dir, withCodec(lengthCodec{})))
+		assert.NoError(t, openAt(dir, withCodec(lengthCodec{})))
+
+		// The stored values would be given to the wrong decoder, or no decoder at all.
+		assert.True(t, errors.Is(openAt(dir, withCodec(&upperCodec{})), ErrFormatMismatch))
+		assert.True(t, errors.Is(openAt(dir, withCodec(nil)), ErrFormatMismatch))
+
+		// A database without a codec cannot be opened with one either.
+		dir, cleanup = NewTempDirectory(t)
+		defer cleanup()
+
+		assert.NoError(t, openAt(dir, withCodec(nil)))
+		assert.True(t, errors.Is(openAt(dir, withCodec(lengthCodec{})), ErrFormatMismatch))
+
+		// A codec without a name could never be told apart from another codec.
+		for _, name := range []string{"", "two\nlines"} {
+			err := openAt(dir, withCodec(namedCodec{name: name}))
+			assert.True(t, errors.Is(err, ErrBadFormatName), "name %q", name)
+		}
+	})
+
+	t.Run("comparator", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		reverse := func(options *Options) {
+			options.Comparator = func(a, b []byte) int {
+				return bytes.Compare(b, a)
+			}
+			options.ComparatorName = "reverse"
+		}
+		assert.NoError(t, openAt(dir, reverse))
+		assert.NoError(t, openAt(dir, reverse))
+
+		// The keys would be in the wrong order for the default comparator.
+		assert.True(t, errors.Is(openAt(dir, func(options *Options) {}), ErrFormatMismatch))
+		assert.True(t, errors.Is(openAt(dir, func(options *Options) {
+			options.Comparator, options.ComparatorName = nil, ""
+		}), ErrFormatMismatch))
+
+		// A comparator has to be named.
+		err := openAt(dir, func(options *Options) {
+			reverse(options)
+			options.ComparatorName = ""
+		})
+		assert.True(t, errors.Is(err, ErrBadFormatName))
+	})
+
+	t.Run("written before the format was recorded", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		assert.NoError(t, openAt(dir, func(options *Options) {}))
+		formatPath := path.Join(dir, "data", formatFileName)
+		assert.NoError(t, os.Remove(formatPath))
+
+		// The format is recorded the next time the database is opened.
+		assert.NoError(t, openAt(dir, func(options *Options) {}))
+		stored, err := ioutil.ReadFile(formatPath)
+		assert.NoError(t, err)
+		format, err := newDBFormat(DefaultOptions())
+		assert.NoError(t, err)
+		assert.Equal(t, format.Encode(), stored)
+	})
+}
+
+func TestDB_StartFileId(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	// write will fill up a few value files and WAL segments and return the ids of every file.
+	write := func(db *DB) map[uint64]FileType {
+		for i := 0; i < 8; i++ {
+			_, _, _, err := db.values.Write(nil, []byte(fmt.Sprintf("value %d", i)))
+			assert.NoError(t, err)
+
+			result := make(chan error, 1)
+			assert.NoError(t, db.enqueue(walTransaction{
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key %d", i)),
+						Value: []byte("value"),
+					},
+				},
+			}, result))
+			assert.NoError(t, <-result)
+
+			_, err = db.RotateWAL()
+			assert.NoError(t, err)
+		}
+
+		files, err := db.Files()
+		assert.NoError(t, err)
+
+		ids := map[uint64]FileType{}
+		for _, file := range files {
+			ids[file.Id] = file.Type
+		}
+		return ids
+	}
+
+	openAt := func(name string, startFileId uint64) *DB {
+		options := DefaultOptions()
+		options.Directory = path.Join(dir, name)
+		options.MaxValueChunkSize = 16
+		options.StartFileId = startFileId
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		return db
+	}
+
+	first, second := openAt("first", 0), openAt("second", 1<<32)
+	firstIds, secondIds := write(first), write(second)
+	assert.NoError(t, first.Close())
+	assert.NoError(t, second.Close())
+
+	for id := range firstIds {
+		assert.Less(t, id, uint64(1<<32))
+		_, ok := secondIds[id]
+		assert.False(t, ok, "file id %d is used by both databases", id)
+	}
+
+	for id := range secondIds {
+		assert.GreaterOrEqual(t, id, uint64(1<<32))
+	}
+
+	// Ids should continue from the existing files when they are above the start.
+	highest := uint64(0)
+	for id, kind := range secondIds {
+		if kind == FileTypeWAL && id > highest {
+			highest = id
+		}
+	}
+
+	second = openAt("second", 1<<32)
+	segmentId, err := second.RotateWAL()
+	assert.NoError(t, err)
+	assert.Greater(t, segmentId, highest)
+	assert.NoError(t, second.Close())
+}
+
+func TestDB_StrictMode(t *testing.T) {
+	set := func(key string, value []byte) walTransactionChange {
+		return walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   []byte(key),
+			Value: value,
+		}
+	}
+
+	remove := func(key string) walTransactionChange {
+		return walTransactionChange{
+			Type: walTransactionChangeTypeDelete,
+			Key:  []byte(key),
+		}
+	}
+
+	invariants := []struct {
+		name     string
+		expected error
+		changes  []walTransactionChange
+	}{
+		{
+			name:     "duplicate keys",
+			expected: ErrDuplicateKey,
+			changes: []walTransactionChange{
+				set("a", []byte("one")), set("b", []byte("two")), remove("a"),
+			},
+		},
+		{
+			name:     "nil value",
+			expected: ErrNilValue,
+			changes:  []walTransactionChange{set("a", nil)},
+		},
+		{
+			name:     "empty key",
+			expected: ErrBadKeySize,
+			changes:  []walTransactionChange{set("", []byte("one"))},
+		},
+		{
+			name:     "key too large",
+			expected: ErrBadKeySize,
+			changes:  []walTransactionChange{remove(strings.Repeat("a", 17))},
+		},
+		{
+			name:     "unknown change type",
+			expected: ErrUnknownChangeType,
+			changes: []walTransactionChange{
+				{
+					Type: walTransactionChangeType(100),
+					Key:  []byte("a"),
+				},
+			},
+		},
+	}
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict %t", strict), func(t *testing.T) {
+			dir, cleanup := NewTempDirectory(t)
+			defer cleanup()
+
+			options := DefaultOptions()
+			options.Directory = dir
+			options.StrictMode = strict
+			options.MaxKeySize = 16
+
+			db, err := Open(options)
+			assert.NoError(t, err)
+			defer db.Close()
+
+			commit := func(changes []walTransactionChange) error {
+				result := make(chan error, 1)
+				if err := db.enqueue(walTransaction{Entries: changes}, result); err != nil {
+					return err
+				}
+
+				return <-result
+			}
+
+			// A transaction that follows every rule is always committed.
+			assert.NoError(t, commit([]walTransactionChange{
+				set("a", []byte("one")), set("b", []byte{}), remove("c"),
+				set(strings.Repeat("d", 16), []byte("two")),
+			}))
+
+			for _, invariant := range invariants {
+				t.Run(invariant.name, func(t *testing.T) {
+					err := commit(invariant.changes)
+					if !strict {
+						assert.NoError(t, err)
+						return
+					}
+
+					assert.True(t, errors.Is(err, invariant.expected), "unexpected error %v", err)
+				})
+			}
+
+			// Nothing that was rejected should have been written to the WAL.
+			if strict {
+				itr, err := db.wal.ReadFrom(0)
+				assert.NoError(t, err)
+				assert.True(t, itr.Valid())
+				itr.Next()
+				assert.False(t, itr.Valid())
+				assert.NoError(t, itr.Err())
+			}
+		})
+	}
+
+	t.Run("comparator", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// Keys that the comparator considers equal are the same key.
+		options := DefaultOptions()
+		options.Directory = dir
+		options.StrictMode = true
+		options.Comparator = func(a, b []byte) int {
+			return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+		}
+		options.ComparatorName = "case insensitive"
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		err = db.enqueue(walTransaction{
+			Entries: []walTransactionChange{set("key", []byte("one")), remove("KEY")},
+		}, nil)
+		assert.True(t, errors.Is(err, ErrDuplicateKey))
+	})
+}
+
+func TestDB_RotateWAL(t *testing.T) {
+	t.Run("mid workload", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.PendingWritesBuffer = 16
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		numberOfWrites := 200
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < numberOfWrites; i++ {
+				db.enqueue(walTransaction{
+					TransactionId: uint64(i + 1),
+					Entries: []walTransactionChange{
+						{
+							Type:  walTransactionChangeTypeSet,
+							Key:   []byte("key"),
+							Value: []byte("value"),
+						},
+					},
+				}, nil)
+			}
+		}()
+
+		previousSegmentId := uint64(0)
+		for i := 0; i < 5; i++ {
+			segmentId, err := db.RotateWAL()
+			assert.NoError(t, err)
+			assert.Greater(t, segmentId, previousSegmentId)
+			previousSegmentId = segmentId
+		}
+
+		<-done
+		assert.NoError(t, db.Drain())
+		assert.NoError(t, db.Close())
+
+		// No transactions should be lost or duplicated across the segment boundaries.
+		segmentIds, err := getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, len(segmentIds), 5)
+
+		transactionId := uint64(1)
+		for _, segmentId := range segmentIds {
+			segment, err := openWalSegment(dir, segmentId, int32(options.MaxWALSegmentSize), false)
+			assert.NoError(t, err)
+
+			transactions, err := segment.GetTransactions()
+			assert.NoError(t, err)
+			for _, transaction := range transactions {
+				assert.Equal(t, transactionId, transaction.TransactionId)
+				transactionId++
+			}
+			assert.NoError(t, segment.Close())
+		}
+		assert.Equal(t, uint64(numberOfWrites+1), transactionId)
+	})
+}
+
+func TestDB_CommitBatchWindow(t *testing.T) {
+	newTransaction := func(transactionId uint64) walTransaction {
+		return walTransaction{
+			TransactionId: transactionId,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: []byte("value"),
+				},
+			},
+		}
+	}
+
+	t.Run("single write commits within the window", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.CommitBatchWindow = 50 * time.Millisecond
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		result := make(chan error, 1)
+		start := time.Now()
+		db.enqueue(newTransaction(1), result)
+
+		select {
+		case err := <-result:
+			assert.NoError(t, err)
+		case <-time.After(options.CommitBatchWindow * 10):
+			t.Fatal("commit was not returned within the batch window")
+		}
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(options.CommitBatchWindow))
+
+		// The commit should be durable once it has returned, without calling Flush or Close.
+		segment, err := openWalSegment(dir, 1, int32(options.MaxWALSegmentSize), false)
+		assert.NoError(t, err)
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 1)
+		assert.NoError(t, segment.Close())
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.PendingWritesBuffer = 8
+		options.CommitBatchWindow = time.Millisecond
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		numberOfWrites := 50
+		results := make([]chan error, numberOfWrites)
+		for i := range results {
+			results[i] = make(chan error, 1)
+			db.enqueue(newTransaction(uint64(i+1)), results[i])
+		}
+
+		// A drain in the middle of a batch should still be answered after the batch.
+		assert.NoError(t, db.Drain())
+		for _, result := range results {
+			assert.NoError(t, <-result)
+		}
+		assert.NoError(t, db.Close())
+
+		transactionId := uint64(1)
+		segmentIds, err := getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+		for _, segmentId := range segmentIds {
+			segment, err := openWalSegment(dir, segmentId, int32(options.MaxWALSegmentSize), false)
+			assert.NoError(t, err)
+			transactions, err := segment.GetTransactions()
+			assert.NoError(t, err)
+			for _, transaction := range transactions {
+				assert.Equal(t, transactionId, transaction.TransactionId)
+				transactionId++
+			}
+			assert.NoError(t, segment.Close())
+		}
+		assert.Equal(t, uint64(numberOfWrites+1), transactionId)
+	})
+
+	// Every commit should be synced before its result is sent, whether or not commits are batched.
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		t.Run(fmt.Sprintf("sync failure window %s", window), func(t *testing.T) {
+			dir, cleanup := NewTempDirectory(t)
+			defer cleanup()
+
+			options := DefaultOptions()
+			options.Directory = dir
+			options.CommitBatchWindow = window
+			db := newDBForTest(t, options)
+
+			commit := func() error {
+				result := make(chan error, 1)
+				assert.NoError(t, db.enqueue(newTransaction(0), result))
+				assert.True(t, db.Step())
+				return <-result
+			}
+
+			assert.NoError(t, commit())
+
+			errSync := errors.New("sync failed")
+			file := newFaultyFile(db.wal.currentSegment.File)
+			file.FailSyncs(errSync)
+			db.wal.currentSegment.File = file
+
+			err := commit()
+			assert.True(t, errors.Is(err, errSync))
+			assert.True(t, errors.Is(err, ErrWritingFile))
+
+			// The writes that failed to sync may never reach the disk even if a later sync
+			// succeeds, so nothing else can be committed.
+			assert.True(t, errors.Is(commit(), errSync))
+			assert.True(t, errors.Is(db.Flush(), errSync))
+			assert.True(t, errors.Is(db.Close(), errSync))
+
+			// Once the database is reopened and the WAL is recovered commits should work again.
+			db = newDBForTest(t, options)
+			assert.NoError(t, commit())
+			assert.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestDB_CoalesceWrites(t *testing.T) {
+	set := func(key string, value string) walTransactionChange {
+		return walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   []byte(key),
+			Value: []byte(value),
+		}
+	}
+
+	remove := func(key string) walTransactionChange {
+		return walTransactionChange{
+			Type: walTransactionChangeTypeDelete,
+			Key:  []byte(key),
+		}
+	}
+
+	// commit will queue every transaction and then commit them all in a single batch. The changes
+	// of each transaction in the WAL are returned.
+	commit := func(
+		t *testing.T, coalesce bool, transactions ...[]walTransactionChange,
+	) [][]walTransactionChange {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.Directory = dir
+		options.CommitBatchWindow = time.Millisecond
+		options.PendingWritesBuffer = len(transactions)
+		options.CoalesceWrites = coalesce
+		db := newDBForTest(t, options)
+
+		results := make([]chan error, len(transactions))
+		for i, changes := range transactions {
+			results[i] = make(chan error, 1)
+			assert.NoError(t, db.enqueue(walTransaction{Entries: changes}, results[i]))
+		}
+
+		assert.True(t, db.Step())
+		for _, result := range results {
+			assert.NoError(t, <-result)
+		}
+
+		itr, err := db.wal.ReadFrom(0)
+		assert.NoError(t, err)
+
+		written := make([][]walTransactionChange, 0)
+		for ; itr.Valid(); itr.Next() {
+			txn := itr.Transaction()
+			assert.Equal(t, uint64(len(written)+1), txn.TransactionId)
+			written = append(written, txn.Entries)
+		}
+		assert.NoError(t, itr.Err())
+		assert.NoError(t, db.Close())
+		return written
+	}
+
+	t.Run("same key", func(t *testing.T) {
+		transactions := make([][]walTransactionChange, 100)
+		for i := range transactions {
+			transactions[i] = []walTransactionChange{set("key", fmt.Sprintf("value %d", i))}
+		}
+
+		assert.Len(t, commit(t, false, transactions...), 100)
+		assert.Equal(t, [][]walTransactionChange{
+			{set("key", "value 99")},
+		}, commit(t, true, transactions...))
+	})
+
+	t.Run("delete after a set", func(t *testing.T) {
+		assert.Equal(t, [][]walTransactionChange{
+			{remove("key")},
+		}, commit(t, true,
+			[]walTransactionChange{set("key", "one")},
+			[]walTransactionChange{set("key", "two")},
+			[]walTransactionChange{remove("key")},
+		))
+	})
+
+	t.Run("keeps order across keys", func(t *testing.T) {
+		transactions := [][]walTransactionChange{
+			{set("a", "one")}, {set("b", "one")}, {set("a", "two")}, {set("a", "three")},
+			{set("b", "two")},
+		}
+
+		assert.Equal(t, [][]walTransactionChange{
+			{set("a", "one")}, {set("b", "one")}, {set("a", "three")}, {set("b", "two")},
+		}, commit(t, true, transactions...))
+	})
+
+	t.Run("keeps transaction boundaries", func(t *testing.T) {
+		transactions := [][]walTransactionChange{
+			{set("a", "one")}, {set("a", "two"), set("b", "one")}, {set("a", "three")},
+		}
+
+		assert.Equal(t, transactions, commit(t, true, transactions...))
+	})
+
+	t.Run("result of the replacement", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// The clock goes backwards after the first transaction, so the next append fails.
+		now := time.Unix(1000, 0)
+		options := DefaultOptions()
+		options.Directory = dir
+		options.CommitBatchWindow = time.Millisecond
+		options.CoalesceWrites = true
+		options.RejectClockRegressions = true
+		options.Clock = func() time.Time {
+			defer func() {
+				now = now.Add(-time.Minute)
+			}()
+			return now
+		}
+		db := newDBForTest(t, options)
+
+		results := make([]chan error, 3)
+		for i, key := range []string{"b", "a", "a"} {
+			results[i] = make(chan error, 1)
+			assert.NoError(t, db.enqueue(walTransaction{
+				Entries: []walTransactionChange{set(key, "value")},
+			}, results[i]))
+		}
+		assert.True(t, db.Step())
+
+		// The dropped transaction should fail along with the one that replaced it.
+		assert.NoError(t, <-results[0])
+		assert.Equal(t, ErrClockRegression, <-results[1])
+		assert.Equal(t, ErrClockRegression, <-results[2])
+		assert.NoError(t, db.Close())
+	})
+}
+
+func BenchmarkDB_CommitBatchWindow(b *testing.B) {
+	for _, window := range []time.Duration{0, 100 * time.Microsecond, time.Millisecond} {
+		b.Run(window.String(), func(b *testing.B) {
+			dir, cleanup := NewTempDirectory(b)
+			defer cleanup()
+
+			options := DefaultOptions()
+			options.WALDirectory = dir
+			options.DataDirectory = dir
+			options.PendingWritesBuffer = 64
+			options.CommitBatchWindow = window
+
+			db, err := Open(options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			var transactionId uint64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				result := make(chan error, 1)
+				for pb.Next() {
+					db.enqueue(walTransaction{
+						TransactionId: atomic.AddUint64(&transactionId, 1),
+						Entries: []walTransactionChange{
+							{
+								Type:  walTransactionChangeTypeSet,
+								Key:   []byte("key"),
+								Value: []byte("value"),
+							},
+						},
+					}, result)
+					if err := <-result; err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
 }
@@ -3,8 +3,36 @@ package lsmtree
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrOpeningFile is the class of errors returned when a file or directory used by the database
+	// could not be opened or created. The underlying error can be retrieved with errors.Unwrap.
+	ErrOpeningFile = errors.New("could not open file")
+
+	// ErrReadingFile is the class of errors returned when data could not be read from one of the
+	// database's files. The underlying error can be retrieved with errors.Unwrap.
+	ErrReadingFile = errors.New("could not read file")
+
+	// ErrWritingFile is the class of errors returned when data could not be written or synced to
+	// one of the database's files. The underlying error can be retrieved with errors.Unwrap.
+	ErrWritingFile = errors.New("could not write file")
+
+	// ErrDiskFull is returned when a write to one of the database's files failed because the
+	// filesystem has run out of space. Errors that match ErrDiskFull will also match
+	// ErrWritingFile. When a write fails this way the space that was reserved for it is given back
+	// whenever possible, so the write can be attempted again once space has been freed.
+	ErrDiskFull = errors.New("disk is full")
 )
 
 var (
@@ -16,9 +44,9 @@ var (
 )
 
 type (
-	// fileType is a simple 1-Byte value that prefixes all of the file names to indicate the type of
-	// file that is being read/written.
-	fileType byte
+	// FileType is a simple 1-Byte value that prefixes all of the file names to indicate the type of
+	// file that is being read/written. It is also reported as the Type of each FileInfo.
+	FileType byte
 
 	// ReaderWriterAt is used as the interface for reading and writing data for the database. It can
 	// be used in nearly every IO portion of the database.
@@ -27,36 +55,363 @@ type (
 		io.WriterAt
 	}
 
+	// boundedFile wraps a ReaderWriterAt and refuses any write that would go past MaxSize. This is
+	// used for files whose space is managed by a freeSpace map, which assumes the file never grows
+	// beyond its size. It is a safety net, if the offsets are ever calculated wrong then the write
+	// fails instead of silently growing the file.
+	boundedFile struct {
+		ReaderWriterAt
+
+		// MaxSize is the number of bytes that can be written to the file.
+		MaxSize int64
+	}
+
+	// teeFile wraps a ReaderWriterAt and writes everything that is written to it to a Secondary as
+	// well, such as a network sink for replication. Reads only ever go to the local file. The
+	// local file is always written first, and the Secondary is only written once the local write
+	// has succeeded.
+	teeFile struct {
+		ReaderWriterAt
+
+		// Secondary receives a copy of every write at the same offset as the local file. The
+		// Secondary is owned by the caller, it is not closed when the teeFile is closed.
+		Secondary io.WriterAt
+
+		// BestEffort will ignore errors from the Secondary so that a failed secondary never fails
+		// a write to the local file. The first error that was ignored is kept. (see SecondaryErr)
+		// If this is false then an error from the Secondary is returned from the write.
+		BestEffort bool
+
+		lock         sync.Mutex
+		secondaryErr error
+	}
+
 	// CanSync is used to check if the current IO interface that a file wrapper is using has a
 	// method that allows its changes to be flushed to the disk.
 	CanSync interface {
 		Sync() error
 	}
+
+	// RetryPolicy is used to configure how writes to the database's files will be retried when
+	// they fail with a transient error (such as EAGAIN or EINTR). Errors that are not transient are
+	// always returned immediately. Syncs are never retried, a failed fsync may have already dropped
+	// the changes that were waiting to be flushed so retrying it could falsely report success.
+	RetryPolicy struct {
+		// MaxAttempts is the total number of times a write will be attempted before the error is
+		// returned. If this is 0 or 1 then writes will not be retried.
+		MaxAttempts int
+
+		// Backoff is how long to wait before the first retry. The wait will double after each
+		// subsequent retry.
+		Backoff time.Duration
+
+		// MaxBackoff is the longest that will be waited between two attempts. If this is 0 then
+		// there is no limit.
+		MaxBackoff time.Duration
+	}
+
+	// FileStatus describes what a file is currently being used for by the database.
+	FileStatus byte
+
+	// FileInfo describes a single file that belongs to the database. (see DB.Files)
+	FileInfo struct {
+		// Type is the kind of file, such as a WAL segment or a value file.
+		Type FileType
+
+		// Id is the id encoded in the file's name. Ids are only unique within a type of file.
+		Id uint64
+
+		// Path is the location of the file, including the directory it is stored in.
+		Path string
+
+		// Size is the size of the file on the disk in bytes. WAL segments are preallocated so
+		// this is not how much data the segment holds.
+		Size int64
+
+		// Status is what the file is currently being used for.
+		Status FileStatus
+	}
+
+	// fileError wraps an error returned while working with one of the database's files. It will
+	// match its class (ErrOpeningFile, ErrReadingFile or ErrWritingFile) with errors.Is while still
+	// unwrapping to the underlying error. This way callers can check for the type of failure as
+	// well as the specific cause (such as os.ErrNotExist).
+	fileError struct {
+		class   error
+		message string
+		err     error
+	}
 )
 
 const (
-	// fileTypeManifest is used as a prefix to designate the manifest file. The manifest file
+	// FileTypeManifest is used as a prefix to designate the manifest file. The manifest file
 	// stores the bare minimum information for the database.
-	fileTypeManifest fileType = iota
+	FileTypeManifest FileType = iota
 
-	// fileTypeWal is used as a prefix to designate write-ahead-log files. Write ahead log files
+	// FileTypeWAL is used as a prefix to designate write-ahead-log files. Write ahead log files
 	// are used to keep track of all of the changes made to the database overtime and use to
 	// guarantee that a given change is atomic.
-	fileTypeWal
+	FileTypeWAL
 
-	// fileTypeHeap is used as a prefix to designate heap files. Heap files are sorted sets of keys
+	// FileTypeHeap is used as a prefix to designate heap files. Heap files are sorted sets of keys
 	// and pointers to a key's value. Heap files are built from memtables and are only flushed to
 	// the disk when the memtable reaches a certain size, or if it were to be manually invoked.
-	fileTypeHeap
+	FileTypeHeap
 
-	// fileTypeValue is used as a prefix to designate value files. Value files are larger than heap
+	// FileTypeValue is used as a prefix to designate value files. Value files are larger than heap
 	// files and are used as append only storage. They are written much more frequently than heap
 	// files and kept in memory for only short periods of time. When a value needs to be retrieved
 	// the file will be located in memory and the address of the value within the file will be read
 	// or the file will be loaded from the disk and have it's value read.
-	fileTypeValue
+	FileTypeValue
 )
 
+const (
+	// FileStatusLive is a file that holds data that is part of the database.
+	FileStatusLive FileStatus = iota
+
+	// FileStatusUnflushed is a WAL segment that has transactions that have not been flushed to a
+	// heap file yet. The segment is needed to recover those transactions if the database is
+	// reopened.
+	FileStatusUnflushed
+
+	// FileStatusPendingDelete is a file that is no longer used and will be removed once nothing
+	// is reading from it.
+	FileStatusPendingDelete
+)
+
+// String returns the name of the file type.
+func (t FileType) String() string {
+	switch t {
+	case FileTypeManifest:
+		return "manifest"
+	case FileTypeWAL:
+		return "wal"
+	case FileTypeHeap:
+		return "heap"
+	case FileTypeValue:
+		return "value"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(t))
+	}
+}
+
+// String returns the name of the file status.
+func (s FileStatus) String() string {
+	switch s {
+	case FileStatusLive:
+		return "live"
+	case FileStatusUnflushed:
+		return "unflushed"
+	case FileStatusPendingDelete:
+		return "pending delete"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(s))
+	}
+}
+
+// newFileError will wrap the error provided in the class specified. The message is a short
+// description of what was being done when the error occurred.
+func newFileError(class, err error, format string, args ...interface{}) error {
+	return &fileError{
+		class:   class,
+		message: fmt.Sprintf(format, args...),
+		err:     err,
+	}
+}
+
+// Error returns the message for the error followed by the underlying error.
+func (e *fileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+// Unwrap returns the underlying error.
+func (e *fileError) Unwrap() error {
+	return e.err
+}
+
+// Is will return true if the target is the class of this error. If the underlying error is
+// because the disk is full then this will also return true for ErrDiskFull.
+func (e *fileError) Is(target error) bool {
+	if target == ErrDiskFull {
+		return isDiskFullError(e.err)
+	}
+
+	return target == e.class
+}
+
+// Do will call fn until it succeeds, returns an error that is not transient, or the maximum number
+// of attempts has been reached. The last error returned from fn is returned.
+func (p RetryPolicy) Do(fn func() error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !isTransientError(err) {
+			return err
+		}
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// isTransientError will return true if the error provided indicates that the operation might
+// succeed if it is tried again.
+func isTransientError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
+
+// newBoundedFile will wrap the file so that nothing can be written past the max size provided.
+func newBoundedFile(file ReaderWriterAt, maxSize int64) *boundedFile {
+	return &boundedFile{
+		ReaderWriterAt: file,
+		MaxSize:        maxSize,
+	}
+}
+
+// WriteAt will write to the underlying file as long as the entire write is within the bounds of
+// the file. If any of it would be past the max size then nothing is written and
+// ErrInsufficientSpace is returned.
+func (f *boundedFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > f.MaxSize {
+		return 0, ErrInsufficientSpace
+	}
+
+	return f.ReaderWriterAt.WriteAt(p, off)
+}
+
+// Truncate will change the size of the underlying file and move the bound to the new size. If the
+// underlying file cannot be truncated then nothing changes.
+func (f *boundedFile) Truncate(size int64) error {
+	truncater, ok := f.ReaderWriterAt.(interface{ Truncate(int64) error })
+	if !ok {
+		return nil
+	}
+
+	if err := truncater.Truncate(size); err != nil {
+		return err
+	}
+
+	f.MaxSize = size
+	return nil
+}
+
+// Sync will sync the underlying file if it can be synced.
+func (f *boundedFile) Sync() error {
+	if canSync, ok := f.ReaderWriterAt.(CanSync); ok {
+		return canSync.Sync()
+	}
+
+	return nil
+}
+
+// Close will close the underlying file if it can be closed.
+func (f *boundedFile) Close() error {
+	if closer, ok := f.ReaderWriterAt.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// newTeeFile will wrap the file so that every write is also written to the secondary.
+func newTeeFile(file ReaderWriterAt, secondary io.WriterAt, bestEffort bool) *teeFile {
+	return &teeFile{
+		ReaderWriterAt: file,
+		Secondary:      secondary,
+		BestEffort:     bestEffort,
+	}
+}
+
+// WriteAt will write to the local file and then to the Secondary. If the local write fails then
+// nothing is written to the Secondary. Writing the same bytes again is safe, so a write that
+// failed because of the Secondary can be retried.
+func (f *teeFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.ReaderWriterAt.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+
+	if _, err := f.Secondary.WriteAt(p, off); err != nil {
+		if !f.BestEffort {
+			return n, fmt.Errorf("writing to the secondary at offset %d: %w", off, err)
+		}
+
+		f.ignore(err)
+	}
+
+	return n, nil
+}
+
+// Sync will sync the local file, and then the Secondary if it implements CanSync. If BestEffort is
+// set then an error from syncing the Secondary is ignored.
+func (f *teeFile) Sync() error {
+	if canSync, ok := f.ReaderWriterAt.(CanSync); ok {
+		if err := canSync.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if canSync, ok := f.Secondary.(CanSync); ok {
+		if err := canSync.Sync(); err != nil {
+			if !f.BestEffort {
+				return fmt.Errorf("syncing the secondary: %w", err)
+			}
+
+			f.ignore(err)
+		}
+	}
+
+	return nil
+}
+
+// Truncate will change the size of the local file if it can be truncated. The Secondary is not
+// truncated, it will grow as the writes to the new space are copied to it.
+func (f *teeFile) Truncate(size int64) error {
+	if truncater, ok := f.ReaderWriterAt.(interface{ Truncate(int64) error }); ok {
+		return truncater.Truncate(size)
+	}
+
+	return nil
+}
+
+// Close will close the local file if it implements io.Closer.
+func (f *teeFile) Close() error {
+	if closer, ok := f.ReaderWriterAt.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// SecondaryErr returns the first error from the Secondary that was ignored because BestEffort is
+// set, or nil if there has not been one.
+func (f *teeFile) SecondaryErr() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.secondaryErr
+}
+
+// ignore will keep the error from the Secondary if it is the first one to be ignored.
+func (f *teeFile) ignore(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.secondaryErr == nil {
+		f.secondaryErr = err
+	}
+}
+
+// isDiskFullError will return true if the error was caused by the filesystem running out of space.
+func isDiskFullError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
 // getPathExists will return true or false indicating whether or not the path specified (file or
 // folder) is valid.
 func getPathExists(path string) bool {
@@ -72,11 +427,15 @@ func getPathExists(path string) bool {
 // in the provided path. The directory will be owned by the current user. If the directory already
 // exists then nothing will change.
 func newDirectory(path string) error {
-	if err := createDirectory(path); err == nil {
-		return takeOwnership(path)
-	} else {
-		return err
+	if err := createDirectory(path); err != nil {
+		return newFileError(ErrOpeningFile, err, "creating directory %s", path)
 	}
+
+	if err := takeOwnership(path); err != nil {
+		return newFileError(ErrOpeningFile, err, "taking ownership of directory %s", path)
+	}
+
+	return nil
 }
 
 // createDirectory will create a directory at the path specified. If the path contains multiple
@@ -90,14 +449,76 @@ func takeOwnership(path string) error {
 	return os.Chown(path, os.Getuid(), os.Getgid())
 }
 
+// directorySyncer is used to sync a directory after a file has been created in it. This is only a
+// variable so that tests can observe when a directory is synced.
+var directorySyncer = syncDirectory
+
+// syncDirectory will flush the directory itself to the disk. This is needed to make files that
+// have been created, renamed or removed in the directory durable.
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return newFileError(ErrOpeningFile, err, "opening directory %s", directory)
+	}
+
+	if err = dir.Sync(); err != nil {
+		_ = dir.Close()
+		return newFileError(ErrWritingFile, err, "syncing directory %s", directory)
+	}
+
+	return dir.Close()
+}
+
+// atomicWriteFile will replace the file with the name provided in the directory with whatever is
+// written by the write func. The data is written to a temporary file in the same directory which
+// is synced and then renamed over the destination. Then the directory is synced so the rename is
+// durable. If anything fails before the rename then the destination is left untouched and the
+// temporary file is removed. This way the destination will always either hold the old contents or
+// the complete new contents, even if the database crashes part way through. This is used to write
+// the format file. (see checkFormat)
+func atomicWriteFile(directory, name string, write func(file ReaderWriterAt) error) (err error) {
+	temp, err := ioutil.TempFile(directory, name+".*.tmp")
+	if err != nil {
+		return newFileError(ErrOpeningFile, err, "creating temporary file for %s", name)
+	}
+
+	// If we fail at any point before the rename then we want to clean up the temporary file.
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = temp.Close()
+			_ = os.Remove(temp.Name())
+		}
+	}()
+
+	if err = write(temp); err != nil {
+		return err
+	}
+
+	if err = temp.Sync(); err != nil {
+		return newFileError(ErrWritingFile, err, "syncing temporary file for %s", name)
+	}
+
+	if err = temp.Close(); err != nil {
+		return newFileError(ErrWritingFile, err, "closing temporary file for %s", name)
+	}
+
+	if err = os.Rename(temp.Name(), path.Join(directory, name)); err != nil {
+		return newFileError(ErrWritingFile, err, "renaming temporary file to %s", name)
+	}
+	renamed = true
+
+	return directorySyncer(directory)
+}
+
 // getValueFileName returns a string representation of the value file name. The name is a
 // hexadecimal encoded byte array, with the first byte being the value file type prefix and the
 // following 8 bytes being the fileId.
 func getValueFileName(fileId uint64) string {
 	n := make([]byte, 9)
 
-	// The first byte of the filename is the fileTypeValue const.
-	n[0] = byte(fileTypeValue)
+	// The first byte of the filename is the FileTypeValue const.
+	n[0] = byte(FileTypeValue)
 
 	// The following 8 bytes is the fileId itself.
 	binary.BigEndian.PutUint64(n[1:], fileId)
@@ -112,8 +533,8 @@ func getValueFileName(fileId uint64) string {
 func getWalSegmentFileName(segmentId uint64) string {
 	n := make([]byte, 9)
 
-	// The first byte of the filename is the fileTypeWal const.
-	n[0] = byte(fileTypeWal)
+	// The first byte of the filename is the FileTypeWAL const.
+	n[0] = byte(FileTypeWAL)
 
 	// The following 8 bytes is the segmentId itself.
 	binary.BigEndian.PutUint64(n[1:], segmentId)
@@ -121,3 +542,131 @@ func getWalSegmentFileName(segmentId uint64) string {
 	// The plaintext filename is the hexadecimal encoding of the 9 bytes.
 	return hex.EncodeToString(n)
 }
+
+// getShardPath returns the path of the shard directory within the directory provided that the
+// file with the id specified belongs in. Each level of the shard is named by 1 byte of the id
+// (hex encoded), starting with the highest byte used for the depth specified. So with a depth of 2
+// the file id 0x012345 is stored in 01/23. If depth is 0 then files are not sharded and the
+// directory is returned as is.
+func getShardPath(directory string, id uint64, depth int) string {
+	for level := 0; level < depth; level++ {
+		directory = path.Join(directory, getShardName(id, depth, level))
+	}
+
+	return directory
+}
+
+// getShardDirectory returns the shard directory for the file with the id specified, creating the
+// shard directory if it does not exist yet. If syncDirectory is true then the parent of any
+// directory that is created is synced so that the new directory is durable.
+func getShardDirectory(directory string, id uint64, depth int, syncDirectory bool) (string, error) {
+	for level := 0; level < depth; level++ {
+		parent := directory
+		directory = path.Join(directory, getShardName(id, depth, level))
+		if getPathExists(directory) {
+			continue
+		}
+
+		if err := newDirectory(directory); err != nil {
+			return "", err
+		}
+
+		if syncDirectory {
+			if err := directorySyncer(parent); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return directory, nil
+}
+
+// getShardName returns the name of the shard directory at the level specified for the file id.
+func getShardName(id uint64, depth, level int) string {
+	return hex.EncodeToString([]byte{byte(id >> uint(8*(depth-level)))})
+}
+
+// isShardDirectoryName will return true if the name provided could be the name of a shard
+// directory.
+func isShardDirectoryName(name string) bool {
+	n, err := hex.DecodeString(name)
+	return err == nil && len(n) == 1
+}
+
+// parseFileName will return the FileType and the id encoded in the file name provided. If the name
+// is not a file name that was generated by the database then ok will be false.
+func parseFileName(name string) (kind FileType, id uint64, ok bool) {
+	n, err := hex.DecodeString(name)
+	if err != nil || len(n) != 9 {
+		return 0, 0, false
+	}
+
+	return FileType(n[0]), binary.BigEndian.Uint64(n[1:]), true
+}
+
+// getFileIds will return the ids of all of the files of the type specified in the directory
+// provided, including files that are in shard directories within it. The ids are returned in
+// ascending order.
+func getFileIds(directory string, kind FileType) ([]uint64, error) {
+	ids, err := appendFileIds(make([]uint64, 0), directory, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids, nil
+}
+
+// appendFileIds will append the ids of the files of the type specified in the directory, and in
+// any shard directories within it, to ids.
+func appendFileIds(ids []uint64, directory string, kind FileType) ([]uint64, error) {
+	files, err := appendFileInfos(make([]FileInfo, 0), directory, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		ids = append(ids, file.Id)
+	}
+
+	return ids, nil
+}
+
+// appendFileInfos will append the files of the type specified in the directory, and in any shard
+// directories within it, to files. The status of every file appended is FileStatusLive.
+func appendFileInfos(files []FileInfo, directory string, kind FileType) ([]FileInfo, error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, newFileError(ErrReadingFile, err, "listing directory %s", directory)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if !isShardDirectoryName(entry.Name()) {
+				continue
+			}
+
+			files, err = appendFileInfos(files, path.Join(directory, entry.Name()), kind)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if fileKind, id, ok := parseFileName(entry.Name()); ok && fileKind == kind {
+			files = append(files, FileInfo{
+				Type:   fileKind,
+				Id:     id,
+				Path:   path.Join(directory, entry.Name()),
+				Size:   entry.Size(),
+				Status: FileStatusLive,
+			})
+		}
+	}
+
+	return files, nil
+}
@@ -1,8 +1,16 @@
 package lsmtree
 
 import (
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
 	"math"
+	"os"
+	"path"
+	"sync"
+	"syscall"
 	"testing"
 )
 
@@ -102,3 +110,440 @@ func TestNewDirectory(t *testing.T) {
 		assert.True(t, exists)
 	})
 }
+
+func TestParseFileName(t *testing.T) {
+	t.Run("value file", func(t *testing.T) {
+		kind, id, ok := parseFileName(getValueFileName(532532))
+		assert.True(t, ok)
+		assert.Equal(t, FileTypeValue, kind)
+		assert.Equal(t, uint64(532532), id)
+	})
+
+	t.Run("wal segment", func(t *testing.T) {
+		kind, id, ok := parseFileName(getWalSegmentFileName(math.MaxUint64))
+		assert.True(t, ok)
+		assert.Equal(t, FileTypeWAL, kind)
+		assert.Equal(t, uint64(math.MaxUint64), id)
+	})
+
+	t.Run("not a database file", func(t *testing.T) {
+		_, _, ok := parseFileName("not a file")
+		assert.False(t, ok)
+
+		_, _, ok = parseFileName("0300")
+		assert.False(t, ok)
+	})
+}
+
+func TestGetFileIds(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		for _, fileId := range []uint64{5, 1, 3} {
+			file, err := openValueFile(dir, fileId, true)
+			assert.NoError(t, err)
+			assert.NoError(t, file.Close())
+		}
+
+		segment, err := openWalSegment(dir, 2, 1024, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, segment)
+
+		ids, err := getFileIds(dir, FileTypeValue)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 3, 5}, ids)
+
+		ids, err = getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{2}, ids)
+	})
+}
+
+func TestFileError(t *testing.T) {
+	t.Run("wrapped chain", func(t *testing.T) {
+		err := newFileError(ErrReadingFile, io.ErrUnexpectedEOF, "reading file %d", 1)
+		assert.EqualError(t, err, "reading file 1: unexpected EOF")
+		assert.True(t, errors.Is(err, ErrReadingFile))
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+		assert.False(t, errors.Is(err, ErrWritingFile))
+		assert.False(t, errors.Is(err, ErrOpeningFile))
+		assert.Equal(t, io.ErrUnexpectedEOF, errors.Unwrap(err))
+	})
+
+	t.Run("wrapping a sentinel", func(t *testing.T) {
+		err := newFileError(ErrReadingFile, ErrCantReadFreeSpace, "reading free space")
+		assert.True(t, errors.Is(err, ErrReadingFile))
+		assert.True(t, errors.Is(err, ErrCantReadFreeSpace))
+	})
+}
+
+func TestAtomicWriteFile(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		err := atomicWriteFile(dir, "file", func(file ReaderWriterAt) error {
+			_, err := file.WriteAt([]byte("contents"), 0)
+			return err
+		})
+		assert.NoError(t, err)
+
+		contents, err := ioutil.ReadFile(path.Join(dir, "file"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("contents"), contents)
+
+		// Only the destination should be left in the directory.
+		files, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+
+	t.Run("replaces existing", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		err := ioutil.WriteFile(path.Join(dir, "file"), []byte("old contents"), 0600)
+		assert.NoError(t, err)
+
+		err = atomicWriteFile(dir, "file", func(file ReaderWriterAt) error {
+			_, err := file.WriteAt([]byte("new"), 0)
+			return err
+		})
+		assert.NoError(t, err)
+
+		contents, err := ioutil.ReadFile(path.Join(dir, "file"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), contents)
+	})
+
+	t.Run("failure before rename", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		err := ioutil.WriteFile(path.Join(dir, "file"), []byte("old contents"), 0600)
+		assert.NoError(t, err)
+
+		err = atomicWriteFile(dir, "file", func(file ReaderWriterAt) error {
+			faulty := newFaultyFile(file)
+
+			// The first write makes it to the file, the second one fails.
+			if _, err := faulty.WriteAt([]byte("new"), 0); err != nil {
+				return err
+			}
+			faulty.FailWrites(syscall.EIO)
+			_, err := faulty.WriteAt([]byte("new"), 3)
+			return err
+		})
+		assert.True(t, errors.Is(err, syscall.EIO))
+
+		contents, err := ioutil.ReadFile(path.Join(dir, "file"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("old contents"), contents)
+
+		// The temporary file should have been cleaned up.
+		files, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+}
+
+func TestDirectorySync(t *testing.T) {
+	// countDirectorySyncs will replace the directorySyncer for the duration of the test and return
+	// a pointer to the number of times a directory has been synced.
+	countDirectorySyncs := func() (*int, func()) {
+		syncs := 0
+		original := directorySyncer
+		directorySyncer = func(directory string) error {
+			syncs++
+			return original(directory)
+		}
+		return &syncs, func() {
+			directorySyncer = original
+		}
+	}
+
+	t.Run("value file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		syncs, restore := countDirectorySyncs()
+		defer restore()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, *syncs)
+
+		_, err = file.Write([]byte("value"))
+		assert.NoError(t, err)
+		assert.NoError(t, file.Close())
+
+		// Opening a file that already exists should not sync the directory.
+		file, err = openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NoError(t, file.Close())
+		assert.Equal(t, 1, *syncs)
+
+		// And it should be skipped entirely when disabled.
+		file, err = openValueFile(dir, 2, false)
+		assert.NoError(t, err)
+		assert.NoError(t, file.Close())
+		assert.Equal(t, 1, *syncs)
+	})
+
+	t.Run("wal segment", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		syncs, restore := countDirectorySyncs()
+		defer restore()
+
+		segment, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.NoError(t, segment.Close())
+		assert.Equal(t, 1, *syncs)
+
+		segment, err = openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.NoError(t, segment.Close())
+		assert.Equal(t, 1, *syncs)
+
+		segment, err = openWalSegment(dir, 2, 1024, false)
+		assert.NoError(t, err)
+		assert.NoError(t, segment.Close())
+		assert.Equal(t, 1, *syncs)
+	})
+}
+
+func TestShardDirectory(t *testing.T) {
+	t.Run("paths", func(t *testing.T) {
+		assert.Equal(t, "data", getShardPath("data", 0x012345, 0))
+		assert.Equal(t, "data/23", getShardPath("data", 0x012345, 1))
+		assert.Equal(t, "data/01/23", getShardPath("data", 0x012345, 2))
+		assert.Equal(t, "data/00", getShardPath("data", 0xff, 1))
+		assert.Equal(t, "data/01", getShardPath("data", 0x100, 1))
+	})
+
+	t.Run("value files", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 16, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		manager.shardDepth = 1
+
+		// Write value files 0x1fe through 0x201 so that they span two shards.
+		manager.currentFileId = 0x1fe
+		type location struct {
+			fileId, offset uint64
+			value          []byte
+		}
+		locations := make([]location, 0)
+		for i := 0; i < 4; i++ {
+			value := []byte(fmt.Sprintf("value %d is long", i))
+			fileId, offset, _, err := manager.Write(nil, value)
+			assert.NoError(t, err)
+			locations = append(locations, location{fileId, offset, value})
+		}
+		assert.NoError(t, manager.Close())
+
+		for _, fileId := range []uint64{0x1fe, 0x1ff} {
+			assert.FileExists(t, path.Join(dir, "01", getValueFileName(fileId)))
+		}
+		for _, fileId := range []uint64{0x200, 0x201} {
+			assert.FileExists(t, path.Join(dir, "02", getValueFileName(fileId)))
+		}
+
+		ids, err := getFileIds(dir, FileTypeValue)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{0x1fe, 0x1ff, 0x200, 0x201}, ids)
+
+		// Reopening should continue with the last file and still find every value.
+		manager, err = newValueManager(dir, 16, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		manager.shardDepth = 1
+		assert.Equal(t, uint64(0x201), manager.currentFileId)
+		for _, l := range locations {
+			value, err := manager.Read(nil, l.fileId, l.offset, uint64(len(l.value)))
+			assert.NoError(t, err)
+			assert.Equal(t, l.value, value)
+		}
+		assert.NoError(t, manager.Close())
+	})
+}
+
+func TestBoundedFile(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	osFile, err := os.Create(path.Join(dir, "bounded"))
+	assert.NoError(t, err)
+
+	file := newBoundedFile(osFile, 16)
+	defer file.Close()
+
+	t.Run("up to the bound", func(t *testing.T) {
+		n, err := file.WriteAt(make([]byte, 8), 8)
+		assert.NoError(t, err)
+		assert.Equal(t, 8, n)
+	})
+
+	t.Run("past the bound", func(t *testing.T) {
+		n, err := file.WriteAt(make([]byte, 9), 8)
+		assert.Equal(t, ErrInsufficientSpace, err)
+		assert.Equal(t, 0, n)
+
+		_, err = file.WriteAt([]byte{1}, 16)
+		assert.Equal(t, ErrInsufficientSpace, err)
+
+		_, err = file.WriteAt([]byte{1}, -1)
+		assert.Equal(t, ErrInsufficientSpace, err)
+
+		// Nothing should have been written past the bound.
+		stat, err := osFile.Stat()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(16), stat.Size())
+	})
+
+	t.Run("truncate moves the bound", func(t *testing.T) {
+		assert.NoError(t, file.Truncate(32))
+		assert.Equal(t, int64(32), file.MaxSize)
+
+		_, err := file.WriteAt([]byte{1}, 31)
+		assert.NoError(t, err)
+		_, err = file.WriteAt([]byte{1}, 32)
+		assert.Equal(t, ErrInsufficientSpace, err)
+	})
+}
+
+// memoryFile is a ReaderWriterAt that is kept in memory.
+type memoryFile struct {
+	lock sync.Mutex
+	data []byte
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if int(off) >= len(f.data) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func TestTeeFile(t *testing.T) {
+	newFiles := func(t *testing.T) (local *os.File, secondary *faultyFile, cleanup func()) {
+		dir, removeDir := NewTempDirectory(t)
+		local, err := os.Create(path.Join(dir, "local"))
+		assert.NoError(t, err)
+
+		return local, newFaultyFile(&memoryFile{}), func() {
+			_ = local.Close()
+			removeDir()
+		}
+	}
+
+	t.Run("writes reach both", func(t *testing.T) {
+		local, secondary, cleanup := newFiles(t)
+		defer cleanup()
+
+		file := newTeeFile(local, secondary, false)
+		for i, p := range [][]byte{[]byte("first"), []byte("second")} {
+			n, err := file.WriteAt(p, int64(i*8))
+			assert.NoError(t, err)
+			assert.Equal(t, len(p), n)
+		}
+		assert.NoError(t, file.Sync())
+
+		expected := []byte("first\x00\x00\x00second")
+		read := make([]byte, len(expected))
+		_, err := file.ReadAt(read, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, read)
+
+		_, err = secondary.ReadAt(read, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, read)
+
+		// Reads should only go to the local file.
+		assert.Equal(t, len(expected), secondary.BytesRead)
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		local, secondary, cleanup := newFiles(t)
+		defer cleanup()
+
+		errReplica := errors.New("replica is down")
+		secondary.FailWrites(errReplica, errors.New("replica is still down"))
+		secondary.FailSyncs(errors.New("replica cannot sync"))
+
+		file := newTeeFile(local, secondary, true)
+		n, err := file.WriteAt([]byte("value"), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+		_, err = file.WriteAt([]byte("value"), 5)
+		assert.NoError(t, err)
+		assert.NoError(t, file.Sync())
+
+		// The local file should still have every write, and the first failure is kept.
+		read := make([]byte, 10)
+		_, err = local.ReadAt(read, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("valuevalue"), read)
+		assert.Equal(t, errReplica, file.SecondaryErr())
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		local, secondary, cleanup := newFiles(t)
+		defer cleanup()
+
+		errReplica := errors.New("replica is down")
+		secondary.FailWrites(errReplica)
+		secondary.FailSyncs(errReplica)
+
+		file := newTeeFile(local, secondary, false)
+		_, err := file.WriteAt([]byte("value"), 0)
+		assert.True(t, errors.Is(err, errReplica))
+		assert.True(t, errors.Is(file.Sync(), errReplica))
+		assert.NoError(t, file.SecondaryErr())
+
+		// Retrying the write should be safe once the secondary is back.
+		_, err = file.WriteAt([]byte("value"), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, secondary.Writes)
+	})
+
+	t.Run("local failure", func(t *testing.T) {
+		local, secondary, cleanup := newFiles(t)
+		defer cleanup()
+
+		errLocal := errors.New("local disk failed")
+		faulty := newFaultyFile(local)
+		faulty.FailWrites(errLocal)
+
+		file := newTeeFile(faulty, secondary, true)
+		_, err := file.WriteAt([]byte("value"), 0)
+		assert.Equal(t, errLocal, err)
+
+		// Nothing should reach the secondary if the local write failed.
+		assert.Equal(t, 0, secondary.Writes)
+	})
+}
@@ -0,0 +1,180 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrFormatMismatch is returned when a database is opened with options that change how the
+	// data already on the disk has to be read, such as disabling checksums for a database that was
+	// written with them.
+	ErrFormatMismatch = errors.New("options do not match the format of the database")
+
+	// ErrBadFormatName is returned when a database is opened with a ValueCodec or a Comparator
+	// whose name cannot be recorded, because it is empty or has a newline in it.
+	ErrBadFormatName = errors.New("name cannot be recorded in the format of the database")
+)
+
+const (
+	// formatFileName is the name of the file in the data directory that records the options that
+	// the data on the disk was written with.
+	formatFileName = "FORMAT"
+)
+
+type (
+	// dbFormat is everything about how a database was written that must be the same every time it
+	// is opened. It is stored in the data directory as one "name=value" line per field.
+	dbFormat struct {
+		// Checksums is true if the entries in the value files are suffixed with a checksum.
+		Checksums bool
+
+		// ValueCodec is the name of the ValueCodec that values are stored with, if there is one.
+		ValueCodec string
+
+		// Comparator is the name of the Comparator that keys are ordered with.
+		Comparator string
+	}
+)
+
+// newDBFormat returns the format that the options provided will write. If a name from the options
+// cannot be recorded in the format file then an error wrapping ErrBadFormatName is returned.
+func newDBFormat(options Options) (dbFormat, error) {
+	format := dbFormat{
+		Checksums:  !options.DisableChecksums,
+		Comparator: options.ComparatorName,
+	}
+
+	if options.Comparator == nil && format.Comparator == "" {
+		format.Comparator = DefaultComparatorName
+	}
+
+	if !isFormatName(format.Comparator) {
+		return format, fmt.Errorf("comparator %q: %w", format.Comparator, ErrBadFormatName)
+	}
+
+	if options.ValueCodec != nil {
+		format.ValueCodec = options.ValueCodec.Name()
+		if !isFormatName(format.ValueCodec) {
+			return format, fmt.Errorf("value codec %q: %w", format.ValueCodec, ErrBadFormatName)
+		}
+	}
+
+	return format, nil
+}
+
+// isFormatName returns true if the name can be stored in the format file.
+func isFormatName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "\r\n")
+}
+
+// checkFormat will make sure that the format of the database in the directory matches the format
+// provided. If the database does not have a format file yet, because it is new or because it was
+// written before the format was recorded, then the format provided is written to the directory.
+// If the formats do not match then an error wrapping ErrFormatMismatch is returned that says
+// which field is different.
+func checkFormat(directory string, format dbFormat) error {
+	if err := newDirectory(directory); err != nil {
+		return err
+	}
+
+	stored, ok, err := readFormat(directory)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return atomicWriteFile(directory, formatFileName, func(file ReaderWriterAt) error {
+			if _, err := file.WriteAt(format.Encode(), 0); err != nil {
+				return newFileError(ErrWritingFile, err, "writing %s", formatFileName)
+			}
+
+			return nil
+		})
+	}
+
+	if stored.Checksums != format.Checksums {
+		return fmt.Errorf(
+			"database was written with checksums %t but DisableChecksums is %t: %w",
+			stored.Checksums, !format.Checksums, ErrFormatMismatch,
+		)
+	}
+
+	if stored.ValueCodec != format.ValueCodec {
+		return fmt.Errorf(
+			"database was written with value codec %q but the value codec is %q: %w",
+			stored.ValueCodec, format.ValueCodec, ErrFormatMismatch,
+		)
+	}
+
+	if stored.Comparator != format.Comparator {
+		return fmt.Errorf(
+			"database was written with comparator %q but the comparator is %q: %w",
+			stored.Comparator, format.Comparator, ErrFormatMismatch,
+		)
+	}
+
+	return nil
+}
+
+// readFormat will read the format file from the directory. If there is no format file then ok
+// will be false.
+func readFormat(directory string) (format dbFormat, ok bool, err error) {
+	data, err := ioutil.ReadFile(path.Join(directory, formatFileName))
+	if os.IsNotExist(err) {
+		return format, false, nil
+	} else if err != nil {
+		return format, false, newFileError(ErrReadingFile, err, "reading %s", formatFileName)
+	}
+
+	if err = format.Decode(data); err != nil {
+		return format, false, err
+	}
+
+	return format, true, nil
+}
+
+// Encode returns the contents of the format file for the format.
+func (f dbFormat) Encode() []byte {
+	return []byte(fmt.Sprintf(
+		"checksums=%t\nvalue_codec=%s\ncomparator=%s\n", f.Checksums, f.ValueCodec, f.Comparator,
+	))
+}
+
+// Decode will read the format from the contents of a format file. Fields that are not known are
+// ignored.
+func (f *dbFormat) Decode(data []byte) error {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		separator := strings.IndexByte(line, '=')
+		if separator < 0 {
+			return fmt.Errorf("reading %s, bad line %q", formatFileName, line)
+		}
+
+		name, value := line[:separator], line[separator+1:]
+		switch name {
+		case "checksums":
+			checksums, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("reading %s, bad checksums %q", formatFileName, value)
+			}
+			f.Checksums = checksums
+
+		case "value_codec":
+			f.ValueCodec = value
+
+		case "comparator":
+			f.Comparator = value
+		}
+	}
+
+	return nil
+}
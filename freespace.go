@@ -22,8 +22,8 @@ type (
 	// This can only be used in fixed size files. That is; files that will never grow larger than
 	// the initial size specified for the freeSpace. The first 4 bytes store the header offset and
 	// the last 4 bytes store the value offset. It is stored entirely as a uint64 to allow for
-	// atomic changes to it. This is done using bit magic where we can atomically add a delta to the
-	// two 32 bit integers in a single addition.
+	// atomic changes to it. Allocations swap in both offsets at once with a compare-and-swap, so
+	// the header offset and the data offset can never be seen out of step with each other.
 	freeSpace uint64
 )
 
@@ -34,50 +34,78 @@ func newFreeSpace(size int32) freeSpace {
 	return freeSpace(high | low)
 }
 
+// newFreeSpaceFromOffsets will return a freeSpace map with the header and data offsets provided.
+func newFreeSpaceFromOffsets(headerOffset, dataOffset int64) freeSpace {
+	return freeSpace(uint64(headerOffset)<<32 | uint64(uint32(dataOffset)))
+}
+
 // newFreeSpaceFromBytes will return the freeSpace map from the first 8 bytes of the provided byte
 // array.
 func newFreeSpaceFromBytes(data []byte) freeSpace {
 	return freeSpace(binary.BigEndian.Uint64(data))
 }
 
-// Allocate will allocate space within the freeSpace to store the header and the data byte arrays.
-// If there is not enough space available then ok will return false. If there is space available for
-// the header and the data then ok will be true and the headerOffset will be the index within the
-// file where the header should be written to, and the dataOffset will be the index within the file
-// where the data can be written.
-func (f *freeSpace) Allocate(header, data []byte) (ok bool, headerOffset, dataOffset int64) {
-	headerSize, dataSize := len(header), -len(data)
-
-	// Basically we are building a single uint64 value that will add to the first 4 bytes of the
-	// freeSpace value, and will subtract from the last 4 bytes. This allows us to keep track of two
-	// offsets within a single value atomically.
-	delta := uint64(headerSize)<<32 | (uint64(dataSize) & 0xffffffff) - 1<<32
-
-	// Once we have the delta we can add it to the current value to update the offsets. This will
-	// give us our new offsets that we can use.
-	result := atomic.AddUint64((*uint64)(f), delta)
-
-	// Split the uint64 back into two int32.
-	newStart, newEnd := int32(result>>32), int32(result)
-
-	// If we allocated too much then we need to deduct the allocation we just made.
-	if newEnd-newStart < 0 {
-		atomic.AddUint64((*uint64)(f), -delta)
+// Allocate will allocate space within the freeSpace to store a header of headerSize bytes and data
+// of dataSize bytes. Both sizes may vary between allocations. If there is not enough space
+// available then ok will return false. If there is space available for the header and the data
+// then ok will be true and the headerOffset will be the index within the file where the header
+// should be written to, and the dataOffset will be the index within the file where the data can be
+// written.
+//
+// Allocate will never over commit the freeSpace, not even for a moment. It uses a compare-and-swap
+// loop that only stores the new offsets when the header and the data fit, retrying if another
+// allocation changed the freeSpace in the meantime. Adding the allocation and then rolling it back
+// when it does not fit is not safe; a rollback that lands after another allocation has already
+// succeeded on top of the over committed space will move the header offset back into that
+// allocation's header. This also means that Space can be read at any time while allocations are
+// happening and will never show more space used than has actually been allocated.
+func (f *freeSpace) Allocate(headerSize, dataSize int) (ok bool, headerOffset, dataOffset int64) {
+	if headerSize < 0 || dataSize < 0 {
 		return false, 0, 0
 	}
 
-	// We need to subtract the headerSize from the start offset, this is because we added onto the
-	// start offset. We don't need to do anything with the end offset because its subtracted from
-	// the end of the file. So we can write forward from that offset without overwriting any other
-	// data.
-	return true, int64(newStart) - int64(headerSize), int64(newEnd)
+	for {
+		current := atomic.LoadUint64((*uint64)(f))
+		start, end := int64(int32(current>>32)), int64(int32(current))
+		newStart, newEnd := start+int64(headerSize), end-int64(dataSize)
+		if newEnd < newStart {
+			return false, 0, 0
+		}
+
+		next := uint64(newFreeSpaceFromOffsets(newStart, newEnd))
+		if atomic.CompareAndSwapUint64((*uint64)(f), current, next) {
+			return true, start, newEnd
+		}
+	}
+}
+
+// Release will give back an allocation that was returned by Allocate. This is only possible if it
+// was the most recent allocation, if anything has been allocated since then the space cannot be
+// given back without corrupting the other allocation, and ok will be false.
+func (f *freeSpace) Release(headerSize, dataSize int, headerOffset, dataOffset int64) (ok bool) {
+	allocated := uint64(newFreeSpaceFromOffsets(headerOffset+int64(headerSize), dataOffset))
+	released := uint64(newFreeSpaceFromOffsets(headerOffset, dataOffset+int64(dataSize)))
+	return atomic.CompareAndSwapUint64((*uint64)(f), allocated, released)
+}
+
+// CanFit will return true if a header of headerSize bytes and data of dataSize bytes could be
+// allocated from the freeSpace right now. Unlike Allocate this does not change the freeSpace, but
+// if allocations are happening at the same time then a subsequent Allocate might still fail.
+func (f *freeSpace) CanFit(headerSize, dataSize int) bool {
+	if headerSize < 0 || dataSize < 0 {
+		return false
+	}
+
+	current := atomic.LoadUint64((*uint64)(f))
+	start, end := int64(int32(current>>32)), int64(int32(current))
+	return end-start >= int64(headerSize)+int64(dataSize)
 }
 
 // Current will return the current headerOffset and dataOffset for the freeSpace. This should NOT be
-// used for writing to a file. It does not reflect a thread safe representation of the free space
-// within the file.
+// used for writing to a file. The offsets are read atomically, but if writes are occurring at the
+// same time then they may have changed by the time they are used.
 func (f *freeSpace) Current() (headerOffset, dataOffset int64) {
-	current := (uint64)(*f)
+	current := atomic.LoadUint64((*uint64)(f))
 	start, end := int32(current>>32), int32(current)
 	return int64(start), int64(end)
 }
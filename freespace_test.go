@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -26,21 +29,21 @@ func TestCombinedDelta(t *testing.T) {
 		fmt.Println(start, end)
 		fmt.Println("Space:", space.Space())
 
-		ok, headerOffset, dataOffset := space.Allocate([]byte("test"), []byte("test"))
+		ok, headerOffset, dataOffset := space.Allocate(len("test"), len("test"))
 		fmt.Println(ok, headerOffset, dataOffset)
 
 		start, end = space.Current()
 		fmt.Println(start, end)
 		fmt.Println("Space:", space.Space())
 
-		ok, headerOffset, dataOffset = space.Allocate([]byte("test1"), []byte("test"))
+		ok, headerOffset, dataOffset = space.Allocate(len("test1"), len("test"))
 		fmt.Println(ok, headerOffset, dataOffset)
 
 		start, end = space.Current()
 		fmt.Println(start, end)
 		fmt.Println("Space:", space.Space())
 
-		ok, headerOffset, dataOffset = space.Allocate([]byte("test1"), []byte("test"))
+		ok, headerOffset, dataOffset = space.Allocate(len("test1"), len("test"))
 		fmt.Println(ok, headerOffset, dataOffset)
 
 		start, end = space.Current()
@@ -80,5 +83,226 @@ func TestCombinedDelta(t *testing.T) {
 		assert.Equal(t, int32(initialStart+startDelta), int32(resultingStart), "start offset did not match")
 		assert.Equal(t, int32(initialEnd+endDelta), int32(resultingEnd)-math.MaxInt32, "end offset did not match")
 	})
+}
+
+func TestFreeSpace_CanFit(t *testing.T) {
+	t.Run("matches allocate", func(t *testing.T) {
+		space := newFreeSpace(128)
+		sizes := [][2]int{
+			{16, 32},
+			{4, 0},
+			{0, 12},
+			{16, 64},
+			{16, 4},
+			{8, 8},
+			{16, 0},
+			{0, 1},
+		}
+
+		for _, size := range sizes {
+			before := space
+			canFit := space.CanFit(size[0], size[1])
+			assert.Equal(t, before, space, "CanFit should not change the free space")
+
+			ok, _, _ := space.Allocate(size[0], size[1])
+			assert.Equal(t, canFit, ok, "header %d data %d", size[0], size[1])
+			if !ok {
+				assert.Equal(t, before, space, "a failed Allocate should not change the free space")
+			}
+		}
+	})
+
+	t.Run("exact fit", func(t *testing.T) {
+		space := newFreeSpace(64)
+		assert.True(t, space.CanFit(16, 40))
+		assert.False(t, space.CanFit(16, 41))
+
+		ok, headerOffset, dataOffset := space.Allocate(16, 40)
+		assert.True(t, ok)
+		assert.Equal(t, int64(8), headerOffset)
+		assert.Equal(t, int64(24), dataOffset)
+		assert.Equal(t, int64(0), space.Space())
+		assert.True(t, space.CanFit(0, 0))
+		assert.False(t, space.CanFit(0, 1))
+	})
+}
+
+func TestFreeSpace_Allocate(t *testing.T) {
+	t.Run("zero data size", func(t *testing.T) {
+		space := newFreeSpace(64)
+		ok, headerOffset, dataOffset := space.Allocate(16, 0)
+		assert.True(t, ok)
+		assert.Equal(t, int64(8), headerOffset)
+		assert.Equal(t, int64(64), dataOffset)
+
+		start, end := space.Current()
+		assert.Equal(t, int64(24), start)
+		assert.Equal(t, int64(64), end)
+	})
+
+	t.Run("concurrent near capacity", func(t *testing.T) {
+		type allocation struct {
+			start, end int64
+		}
+
+		size := int32(16 * 1024)
+		space := newFreeSpace(size)
+
+		numberOfWorkers := 32
+		headers := make([][]allocation, numberOfWorkers)
+		data := make([][]allocation, numberOfWorkers)
+
+		var wg sync.WaitGroup
+		for i := 0; i < numberOfWorkers; i++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				// Keep allocating until the space has been full for a while so that many of
+				// the allocations are made right at the capacity boundary.
+				for failures := 0; failures < 100; {
+					dataSize := 1 + (worker*7+len(data[worker])*13)%64
+					ok, headerOffset, dataOffset := space.Allocate(walTransactionHeaderSize, dataSize)
+					if !ok {
+						failures++
+						continue
+					}
+
+					headers[worker] = append(headers[worker], allocation{
+						start: headerOffset,
+						end:   headerOffset + walTransactionHeaderSize,
+					})
+					data[worker] = append(data[worker], allocation{
+						start: dataOffset,
+						end:   dataOffset + int64(dataSize),
+					})
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		flatten := func(allocations [][]allocation) []allocation {
+			flat := make([]allocation, 0)
+			for _, worker := range allocations {
+				flat = append(flat, worker...)
+			}
+			sort.Slice(flat, func(i, j int) bool {
+				return flat[i].start < flat[j].start
+			})
+			return flat
+		}
+
+		allHeaders, allData := flatten(headers), flatten(data)
+		assert.NotEmpty(t, allHeaders)
+
+		// Headers should be packed from the front of the file without any gaps or overlaps, and
+		// the data should be packed from the back of the file the same way.
+		expectedHeaderOffset := int64(8)
+		for _, header := range allHeaders {
+			assert.Equal(t, expectedHeaderOffset, header.start)
+			expectedHeaderOffset = header.end
+		}
 
+		expectedDataOffset := int64(size)
+		for i := len(allData) - 1; i >= 0; i-- {
+			assert.Equal(t, expectedDataOffset, allData[i].end)
+			expectedDataOffset = allData[i].start
+		}
+		assert.LessOrEqual(t, expectedHeaderOffset, expectedDataOffset)
+
+		start, end := space.Current()
+		assert.Equal(t, expectedHeaderOffset, start)
+		assert.Equal(t, expectedDataOffset, end)
+		assert.Equal(t, expectedDataOffset-expectedHeaderOffset, space.Space())
+		assert.False(t, space.CanFit(walTransactionHeaderSize, int(space.Space())+1))
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		size := int32(16 * 1024)
+		space := newFreeSpace(size)
+
+		numberOfWorkers := 32
+		allocated := make([]int64, numberOfWorkers)
+
+		var wg sync.WaitGroup
+		for i := 0; i < numberOfWorkers; i++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for {
+					// The space should never appear to be over committed.
+					assert.GreaterOrEqual(t, space.Space(), int64(0))
+					ok, _, _ := space.Allocate(walTransactionHeaderSize, 1+worker%64)
+					if !ok {
+						return
+					}
+					allocated[worker] += int64(walTransactionHeaderSize + 1 + worker%64)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		total := int64(0)
+		for _, worker := range allocated {
+			total += worker
+		}
+		assert.Equal(t, int64(size)-8-total, space.Space())
+	})
+}
+
+// BenchmarkFreeSpace measures Allocate with many goroutines allocating from the same freeSpace at
+// once. Run it with -cpu to see how it behaves as contention increases.
+func BenchmarkFreeSpace(b *testing.B) {
+	b.Run("fits", func(b *testing.B) {
+		space := newFreeSpace(math.MaxInt32)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if ok, _, _ := space.Allocate(16, 16); !ok {
+					// Start over once the space is full so every allocation is on the contended
+					// path rather than the full path.
+					atomic.StoreUint64((*uint64)(&space), uint64(newFreeSpace(math.MaxInt32)))
+				}
+			}
+		})
+	})
+
+	b.Run("near capacity", func(b *testing.B) {
+		space := newFreeSpace(math.MaxInt32)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				// Allocations large enough that only a few fit before the space is full.
+				if ok, _, _ := space.Allocate(16, math.MaxInt32/8); !ok {
+					atomic.StoreUint64((*uint64)(&space), uint64(newFreeSpace(math.MaxInt32)))
+				}
+			}
+		})
+	})
+}
+
+func TestFreeSpace_Release(t *testing.T) {
+	t.Run("most recent allocation", func(t *testing.T) {
+		space := newFreeSpace(128)
+		before := space
+
+		ok, headerOffset, dataOffset := space.Allocate(16, 32)
+		assert.True(t, ok)
+		assert.True(t, space.Release(16, 32, headerOffset, dataOffset))
+		assert.Equal(t, before, space)
+
+		// Releasing it a second time should not change anything.
+		assert.False(t, space.Release(16, 32, headerOffset, dataOffset))
+		assert.Equal(t, before, space)
+	})
+
+	t.Run("older allocation", func(t *testing.T) {
+		space := newFreeSpace(128)
+
+		ok, headerOffset, dataOffset := space.Allocate(16, 32)
+		assert.True(t, ok)
+		ok, _, _ = space.Allocate(16, 8)
+		assert.True(t, ok)
+
+		after := space
+		assert.False(t, space.Release(16, 32, headerOffset, dataOffset))
+		assert.Equal(t, after, space)
+	})
 }
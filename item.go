@@ -4,4 +4,8 @@ type Item struct {
 	Key     Key
 	Value   []byte
 	Version uint64
+
+	// Tombstone is true when this version of the key is a delete. A tombstone will not have a
+	// value.
+	Tombstone bool
 }
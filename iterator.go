@@ -1,7 +1,207 @@
 package lsmtree
 
-type Itr interface {
-	Seek(prefix []byte)
-	Next()
-	Item() Item
+import (
+	"container/heap"
+)
+
+type (
+	// Itr is used to move through a sorted set of items. Items are ordered by their key ascending
+	// (according to the database's Comparator), and when there are multiple versions of the same
+	// key they are ordered by their version descending (newest first).
+	Itr interface {
+		// Seek will move the iterator to the first item whose key is greater than or equal to the
+		// prefix provided.
+		Seek(prefix []byte)
+
+		// Next will move the iterator to the next item.
+		Next()
+
+		// Valid will return true if the iterator is currently positioned on an item. Once the
+		// iterator has moved past the last item this will return false.
+		Valid() bool
+
+		// Item returns the item that the iterator is currently positioned on. This should only be
+		// called when Valid returns true.
+		Item() Item
+	}
+
+	// mergeSource is a single iterator that is being merged by a mergeIterator along with its
+	// precedence.
+	mergeSource struct {
+		// Iterator is the source of the items.
+		Iterator Itr
+
+		// Precedence is used to decide which item wins when two sources have the same version of
+		// the same key. The source with the higher precedence (the newer source) wins.
+		Precedence int
+	}
+
+	// mergeIterator combines several sorted iterators into a single sorted stream of items. When
+	// the same key appears in more than one source (or more than once in the same source) only the
+	// newest version of the key that is visible at the snapshot is returned. Tombstones are dropped
+	// unless the iterator was created to keep them, which is needed by compaction.
+	mergeIterator struct {
+		all            []mergeSource
+		sources        mergeHeap
+		compare        Comparator
+		snapshot       uint64
+		keepTombstones bool
+		current        Item
+		valid          bool
+	}
+
+	// mergeHeap is a min-heap of the sources that still have items, ordered by the item each source
+	// is currently positioned on.
+	mergeHeap struct {
+		items   []mergeSource
+		compare Comparator
+	}
+)
+
+var (
+	_ Itr            = &mergeIterator{}
+	_ heap.Interface = &mergeHeap{}
+)
+
+// newMergeIterator will create an iterator that merges all of the sources provided. Only versions
+// less than or equal to the snapshot will be visible, versions that are newer than the snapshot are
+// skipped as if they had never been written. To see the latest version of every key the snapshot
+// should be math.MaxUint64. Every source must be sorted using the comparator provided, if it is nil
+// then DefaultComparator is used. The iterator will be positioned on the first item of the merged
+// stream.
+func newMergeIterator(
+	sources []mergeSource, snapshot uint64, keepTombstones bool, compare Comparator,
+) *mergeIterator {
+	if compare == nil {
+		compare = DefaultComparator
+	}
+
+	i := &mergeIterator{
+		all: sources,
+		sources: mergeHeap{
+			items:   make([]mergeSource, 0, len(sources)),
+			compare: compare,
+		},
+		compare:        compare,
+		snapshot:       snapshot,
+		keepTombstones: keepTombstones,
+	}
+
+	for _, source := range sources {
+		if source.Iterator.Valid() {
+			i.sources.items = append(i.sources.items, source)
+		}
+	}
+	heap.Init(&i.sources)
+	i.advance()
+
+	return i
+}
+
+// Seek will move every source to the prefix provided and position the iterator on the first item
+// with a key greater than or equal to the prefix.
+func (i *mergeIterator) Seek(prefix []byte) {
+	// Sources that have already been exhausted are not in the heap anymore, but they might have
+	// items after the prefix if we are seeking backwards. So every source needs to be seeked.
+	i.sources.items = i.sources.items[:0]
+	for _, source := range i.all {
+		source.Iterator.Seek(prefix)
+		if source.Iterator.Valid() {
+			i.sources.items = append(i.sources.items, source)
+		}
+	}
+
+	heap.Init(&i.sources)
+	i.advance()
+}
+
+// Next will move the iterator to the next key in the merged stream.
+func (i *mergeIterator) Next() {
+	i.advance()
+}
+
+// Valid will return true if the iterator is positioned on an item.
+func (i *mergeIterator) Valid() bool {
+	return i.valid
+}
+
+// Item returns the newest version of the current key.
+func (i *mergeIterator) Item() Item {
+	return i.current
+}
+
+// advance will move the iterator to the next key that should be returned. The newest version of
+// each key is at the top of the heap. Versions that are newer than the snapshot are skipped, and
+// once the newest visible version is found every other version of that key is skipped.
+func (i *mergeIterator) advance() {
+	for i.sources.Len() > 0 {
+		item := i.sources.items[0].Iterator.Item()
+
+		// If this version is not visible to the snapshot then skip just this version, there might
+		// be an older version of the same key that is visible.
+		if item.Version > i.snapshot {
+			i.next()
+			continue
+		}
+
+		// Skip past every other version of this key in all of the sources.
+		for i.sources.Len() > 0 && i.compare(i.sources.items[0].Iterator.Item().Key, item.Key) == 0 {
+			i.next()
+		}
+
+		if item.Tombstone && !i.keepTombstones {
+			continue
+		}
+
+		i.current, i.valid = item, true
+		return
+	}
+
+	i.current, i.valid = Item{}, false
+}
+
+// next will move the source at the top of the heap to its next item, removing it from the heap if
+// it does not have any more items.
+func (i *mergeIterator) next() {
+	i.sources.items[0].Iterator.Next()
+	if i.sources.items[0].Iterator.Valid() {
+		heap.Fix(&i.sources, 0)
+	} else {
+		heap.Pop(&i.sources)
+	}
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.items)
+}
+
+// Less will order the sources by their current key ascending, then by the version of the key
+// descending and then by the precedence of the source descending. This way the newest version of
+// the smallest key is always at the top of the heap.
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i].Iterator.Item(), h.items[j].Iterator.Item()
+	if c := h.compare(a.Key, b.Key); c != 0 {
+		return c < 0
+	}
+
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+
+	return h.items[i].Precedence > h.items[j].Precedence
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(mergeSource))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.items)
+	source := h.items[n-1]
+	h.items = h.items[:n-1]
+	return source
 }
@@ -0,0 +1,256 @@
+package lsmtree
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"sort"
+	"testing"
+)
+
+// sliceIterator is a simple Itr over a slice of items that is used to test the iterators that
+// consume other iterators.
+type sliceIterator struct {
+	items   []Item
+	index   int
+	compare Comparator
+}
+
+func newSliceIterator(items ...Item) *sliceIterator {
+	return newSliceIteratorWithComparator(DefaultComparator, items...)
+}
+
+func newSliceIteratorWithComparator(compare Comparator, items ...Item) *sliceIterator {
+	sort.SliceStable(items, func(i, j int) bool {
+		if c := compare(items[i].Key, items[j].Key); c != 0 {
+			return c < 0
+		}
+		return items[i].Version > items[j].Version
+	})
+	return &sliceIterator{
+		items:   items,
+		compare: compare,
+	}
+}
+
+func (i *sliceIterator) Seek(prefix []byte) {
+	i.index = sort.Search(len(i.items), func(x int) bool {
+		return i.compare(i.items[x].Key, prefix) >= 0
+	})
+}
+
+func (i *sliceIterator) Next() {
+	i.index++
+}
+
+func (i *sliceIterator) Valid() bool {
+	return i.index < len(i.items)
+}
+
+func (i *sliceIterator) Item() Item {
+	return i.items[i.index]
+}
+
+func collectItems(itr Itr) []Item {
+	items := make([]Item, 0)
+	for ; itr.Valid(); itr.Next() {
+		items = append(items, itr.Item())
+	}
+	return items
+}
+
+func TestMergeIterator(t *testing.T) {
+	newSources := func() []mergeSource {
+		return []mergeSource{
+			{
+				// The oldest source.
+				Precedence: 0,
+				Iterator: newSliceIterator(
+					Item{Key: Key("a"), Value: []byte("a1"), Version: 1},
+					Item{Key: Key("b"), Value: []byte("b1"), Version: 1},
+					Item{Key: Key("d"), Value: []byte("d1"), Version: 1},
+					Item{Key: Key("f"), Value: []byte("f1"), Version: 1},
+				),
+			},
+			{
+				Precedence: 1,
+				Iterator: newSliceIterator(
+					Item{Key: Key("b"), Value: []byte("b2"), Version: 2},
+					Item{Key: Key("c"), Value: []byte("c2"), Version: 2},
+					Item{Key: Key("d"), Version: 2, Tombstone: true},
+				),
+			},
+			{
+				// The newest source.
+				Precedence: 2,
+				Iterator: newSliceIterator(
+					Item{Key: Key("b"), Value: []byte("b3"), Version: 3},
+					Item{Key: Key("b"), Value: []byte("b2.5"), Version: 2},
+					Item{Key: Key("e"), Value: []byte("e3"), Version: 3},
+					Item{Key: Key("f"), Value: []byte("f-same-version"), Version: 1},
+				),
+			},
+		}
+	}
+
+	t.Run("overlapping keys", func(t *testing.T) {
+		itr := newMergeIterator(newSources(), math.MaxUint64, false, nil)
+		assert.Equal(t, []Item{
+			{Key: Key("a"), Value: []byte("a1"), Version: 1},
+			{Key: Key("b"), Value: []byte("b3"), Version: 3},
+			{Key: Key("c"), Value: []byte("c2"), Version: 2},
+			{Key: Key("e"), Value: []byte("e3"), Version: 3},
+			{Key: Key("f"), Value: []byte("f-same-version"), Version: 1},
+		}, collectItems(itr))
+	})
+
+	t.Run("keep tombstones", func(t *testing.T) {
+		itr := newMergeIterator(newSources(), math.MaxUint64, true, nil)
+		assert.Equal(t, []Item{
+			{Key: Key("a"), Value: []byte("a1"), Version: 1},
+			{Key: Key("b"), Value: []byte("b3"), Version: 3},
+			{Key: Key("c"), Value: []byte("c2"), Version: 2},
+			{Key: Key("d"), Version: 2, Tombstone: true},
+			{Key: Key("e"), Value: []byte("e3"), Version: 3},
+			{Key: Key("f"), Value: []byte("f-same-version"), Version: 1},
+		}, collectItems(itr))
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		itr := newMergeIterator(newSources(), math.MaxUint64, false, nil)
+		itr.Seek([]byte("c"))
+		assert.True(t, itr.Valid())
+		assert.Equal(t, Key("c"), itr.Item().Key)
+
+		// Seek past the end and then back to the beginning.
+		itr.Seek([]byte("z"))
+		assert.False(t, itr.Valid())
+
+		itr.Seek([]byte("a"))
+		assert.Len(t, collectItems(itr), 5)
+	})
+
+	t.Run("no sources", func(t *testing.T) {
+		itr := newMergeIterator(nil, math.MaxUint64, false, nil)
+		assert.False(t, itr.Valid())
+	})
+}
+
+func TestMergeIterator_Snapshot(t *testing.T) {
+	t.Run("versions straddling the snapshot", func(t *testing.T) {
+		itr := newMergeIterator([]mergeSource{
+			{
+				Precedence: 0,
+				Iterator: newSliceIterator(
+					Item{Key: Key("a"), Value: []byte("a1"), Version: 1},
+					Item{Key: Key("a"), Value: []byte("a3"), Version: 3},
+					Item{Key: Key("a"), Value: []byte("a5"), Version: 5},
+					Item{Key: Key("b"), Value: []byte("b4"), Version: 4},
+				),
+			},
+			{
+				Precedence: 1,
+				Iterator: newSliceIterator(
+					Item{Key: Key("a"), Value: []byte("a2"), Version: 2},
+					Item{Key: Key("c"), Version: 3, Tombstone: true},
+					Item{Key: Key("c"), Value: []byte("c2"), Version: 2},
+					Item{Key: Key("d"), Value: []byte("d1"), Version: 1},
+					Item{Key: Key("d"), Version: 6, Tombstone: true},
+				),
+			},
+		}, 3, false, nil)
+
+		// Only the newest version <= 3 of each key should appear.
+		assert.Equal(t, []Item{
+			{Key: Key("a"), Value: []byte("a3"), Version: 3},
+			{Key: Key("d"), Value: []byte("d1"), Version: 1},
+		}, collectItems(itr))
+	})
+
+	t.Run("writes during the scan are invisible", func(t *testing.T) {
+		source := newSliceIterator(
+			Item{Key: Key("a"), Value: []byte("a1"), Version: 1},
+			Item{Key: Key("b"), Value: []byte("b1"), Version: 1},
+			Item{Key: Key("c"), Value: []byte("c1"), Version: 1},
+		)
+		itr := newMergeIterator([]mergeSource{
+			{
+				Iterator: source,
+			},
+		}, 1, false, nil)
+
+		assert.True(t, itr.Valid())
+		assert.Equal(t, Key("a"), itr.Item().Key)
+
+		// Write newer versions of keys that the iterator has not reached yet, as well as a brand
+		// new key. The items stay sorted by key and then by version descending.
+		source.items = []Item{
+			{Key: Key("a"), Value: []byte("a1"), Version: 1},
+			{Key: Key("b"), Value: []byte("b2"), Version: 2},
+			{Key: Key("b"), Value: []byte("b1"), Version: 1},
+			{Key: Key("bb"), Value: []byte("bb2"), Version: 2},
+			{Key: Key("c"), Version: 2, Tombstone: true},
+			{Key: Key("c"), Value: []byte("c1"), Version: 1},
+		}
+
+		itr.Next()
+		assert.Equal(t, []Item{
+			{Key: Key("b"), Value: []byte("b1"), Version: 1},
+			{Key: Key("c"), Value: []byte("c1"), Version: 1},
+		}, collectItems(itr))
+	})
+}
+
+func TestMergeIterator_Comparator(t *testing.T) {
+	reverse := func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}
+
+	newSources := func() []mergeSource {
+		return []mergeSource{
+			{
+				Precedence: 0,
+				Iterator: newSliceIteratorWithComparator(reverse,
+					Item{Key: Key("a"), Value: []byte("a1"), Version: 1},
+					Item{Key: Key("c"), Value: []byte("c1"), Version: 1},
+					Item{Key: Key("e"), Value: []byte("e1"), Version: 1},
+				),
+			},
+			{
+				Precedence: 1,
+				Iterator: newSliceIteratorWithComparator(reverse,
+					Item{Key: Key("b"), Value: []byte("b2"), Version: 2},
+					Item{Key: Key("c"), Value: []byte("c2"), Version: 2},
+					Item{Key: Key("d"), Version: 2, Tombstone: true},
+				),
+			},
+		}
+	}
+
+	t.Run("reverse order", func(t *testing.T) {
+		itr := newMergeIterator(newSources(), math.MaxUint64, false, reverse)
+		assert.Equal(t, []Item{
+			{Key: Key("e"), Value: []byte("e1"), Version: 1},
+			{Key: Key("c"), Value: []byte("c2"), Version: 2},
+			{Key: Key("b"), Value: []byte("b2"), Version: 2},
+			{Key: Key("a"), Value: []byte("a1"), Version: 1},
+		}, collectItems(itr))
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		itr := newMergeIterator(newSources(), math.MaxUint64, false, reverse)
+
+		// With the reverse order seeking to d should start at the first key that is less than or
+		// equal to d, but d has been deleted.
+		itr.Seek([]byte("d"))
+		assert.True(t, itr.Valid())
+		assert.Equal(t, Key("c"), itr.Item().Key)
+		assert.Equal(t, []byte("c2"), itr.Item().Value)
+
+		itr.Seek([]byte("bb"))
+		assert.Equal(t, []Item{
+			{Key: Key("b"), Value: []byte("b2"), Version: 2},
+			{Key: Key("a"), Value: []byte("a1"), Version: 1},
+		}, collectItems(itr))
+	})
+}
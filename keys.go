@@ -1,6 +1,15 @@
 package lsmtree
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
 type (
+	// Comparator is used to order keys. It must return a negative number when a sorts before b, 0
+	// when a and b are the same key and a positive number when a sorts after b.
+	Comparator func(a, b []byte) int
+
 	// TimestampedKey represents a byte array that will always have an 8 byte suffix to indicate the
 	// transactionId for the item. This is used to implement MVCC.
 	TimestampedKey []byte
@@ -8,4 +17,85 @@ type (
 	// Key represents an array that will NOT have an 8 byte suffix that is used to indicate the
 	// transactionId for the item.
 	Key []byte
+
+	// KeyBuilder is used to build a key out of several parts, such as the fields of a tuple. Every
+	// part starts with a byte for its type, so two different sequences of parts never produce the
+	// same key even if their types differ. Keys built with the same sequence of part types sort
+	// bytewise in the same order as their parts. The zero value is an empty builder that is ready
+	// to use.
+	KeyBuilder struct {
+		key []byte
+	}
+)
+
+const (
+	// keyPartTypeBytes is written before every variable length part of a composite key.
+	keyPartTypeBytes = 0x01
+
+	// keyPartTypeUint64 is written before every number part of a composite key.
+	keyPartTypeUint64 = 0x02
+
+	// keyPartEscape is written after every 0x00 byte within a variable length part of a composite
+	// key so that it is not mistaken for the end of the part.
+	keyPartEscape = 0xFF
+
+	// keyPartTerminator is written after the 0x00 byte that ends a variable length part of a
+	// composite key. It sorts before keyPartEscape so that a part sorts before any longer part
+	// that starts with it.
+	keyPartTerminator = 0x01
 )
+
+// DefaultComparator orders keys bytewise. This is used when no Comparator is provided.
+var DefaultComparator Comparator = bytes.Compare
+
+// DefaultComparatorName is the name of the DefaultComparator.
+const DefaultComparatorName = "bytewise"
+
+// KeyFromString returns the bytes of the string as a key.
+func KeyFromString(s string) Key {
+	return Key(s)
+}
+
+// KeyFromUint64 returns the number as an 8 byte big-endian key, so numbers sort bytewise in the
+// same order as they do numerically.
+func KeyFromUint64(n uint64) Key {
+	key := make(Key, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+// Text will append the string as the next part of the key. It is written the same way as Bytes.
+func (b *KeyBuilder) Text(s string) *KeyBuilder {
+	return b.Bytes([]byte(s))
+}
+
+// Bytes will append the bytes as the next part of the key. The part can have any length, so it is
+// not written with a length header since that would sort shorter parts first regardless of their
+// contents. Instead every 0x00 byte is escaped as 0x00 0xFF and the part is ended with 0x00 0x01.
+func (b *KeyBuilder) Bytes(p []byte) *KeyBuilder {
+	b.key = append(b.key, keyPartTypeBytes)
+	for _, c := range p {
+		b.key = append(b.key, c)
+		if c == 0x00 {
+			b.key = append(b.key, keyPartEscape)
+		}
+	}
+
+	b.key = append(b.key, 0x00, keyPartTerminator)
+	return b
+}
+
+// Uint64 will append the number as the next part of the key. Numbers are always 8 bytes so they
+// do not need to be ended like the variable length parts.
+func (b *KeyBuilder) Uint64(n uint64) *KeyBuilder {
+	b.key = append(append(b.key, keyPartTypeUint64), KeyFromUint64(n)...)
+	return b
+}
+
+// Key returns the key built from the parts appended so far. The key returned is a copy, so the
+// builder can still be appended to afterwards.
+func (b *KeyBuilder) Key() Key {
+	key := make(Key, len(b.key))
+	copy(key, b.key)
+	return key
+}
@@ -0,0 +1,124 @@
+package lsmtree
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestKeyFromString(t *testing.T) {
+	assert.Equal(t, Key("key"), KeyFromString("key"))
+	assert.Empty(t, KeyFromString(""))
+}
+
+func TestKeyFromUint64(t *testing.T) {
+	numbers := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	for i := 0; i < 1000; i++ {
+		numbers = append(numbers, rand.Uint64()>>uint(rand.Intn(64)))
+	}
+
+	keys := make([]Key, len(numbers))
+	for i, n := range numbers {
+		keys[i] = KeyFromUint64(n)
+		assert.Len(t, keys[i], 8)
+	}
+
+	// Sorting the keys bytewise should sort the numbers numerically.
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] < numbers[j]
+	})
+
+	for i, n := range numbers {
+		assert.Equal(t, KeyFromUint64(n), keys[i])
+	}
+}
+
+func TestKeyBuilder(t *testing.T) {
+	t.Run("no prefix collisions", func(t *testing.T) {
+		tuples := [][]string{
+			{"a", "bc"},
+			{"ab", "c"},
+			{"abc"},
+			{"abc", ""},
+			{"", "abc"},
+			{"a\x00", "b"},
+			{"a", "\x00b"},
+			{"a\x00\x01", ""},
+		}
+
+		seen := map[string][]string{}
+		for _, tuple := range tuples {
+			builder := KeyBuilder{}
+			for _, part := range tuple {
+				builder.Text(part)
+			}
+
+			key := string(builder.Key())
+			other, ok := seen[key]
+			assert.False(t, ok, "%q and %q produced the same key", tuple, other)
+			seen[key] = tuple
+		}
+	})
+
+	t.Run("no collisions between part types", func(t *testing.T) {
+		keys := map[string]Key{
+			"four empty strings": (&KeyBuilder{}).Text("").Text("").Text("").Text("").Key(),
+			"one number":         (&KeyBuilder{}).Uint64(0x0001000100010001).Key(),
+			"string then number": (&KeyBuilder{}).Text("").Uint64(0).Key(),
+			"number then string": (&KeyBuilder{}).Uint64(0).Text("").Key(),
+			"bytes of a number":  (&KeyBuilder{}).Bytes(KeyFromUint64(1)).Key(),
+			"number":             (&KeyBuilder{}).Uint64(1).Key(),
+		}
+
+		seen := map[string]string{}
+		for name, key := range keys {
+			other, ok := seen[string(key)]
+			assert.False(t, ok, "%s and %s produced the same key", name, other)
+			seen[string(key)] = name
+		}
+	})
+
+	t.Run("sorts by parts", func(t *testing.T) {
+		// These are already in tuple order, comparing part by part.
+		tuples := []struct {
+			name   string
+			number uint64
+		}{
+			{"", 5},
+			{"a", 0},
+			{"a", 1},
+			{"a", 1 << 40},
+			{"a\x00", 0},
+			{"a\x00\x00", 0},
+			{"a\x01", 0},
+			{"ab", 0},
+			{"b", 0},
+		}
+
+		keys := make([]Key, len(tuples))
+		for i, tuple := range tuples {
+			keys[i] = (&KeyBuilder{}).Text(tuple.name).Uint64(tuple.number).Key()
+		}
+
+		for i := 1; i < len(keys); i++ {
+			assert.True(
+				t, bytes.Compare(keys[i-1], keys[i]) < 0, "%v should sort before %v",
+				tuples[i-1], tuples[i],
+			)
+		}
+	})
+
+	t.Run("key is a copy", func(t *testing.T) {
+		builder := KeyBuilder{}
+		key := builder.Bytes([]byte("a")).Key()
+		builder.Uint64(1)
+		assert.Equal(t, Key("\x01a\x00\x01"), key)
+		assert.Equal(t, append(Key("\x01a\x00\x01\x02"), KeyFromUint64(1)...), builder.Key())
+	})
+}
@@ -0,0 +1,37 @@
+package lsmtree
+
+type (
+	// Logger is used to report what the database is doing in the background, such as rotating WAL
+	// segments or recovering a segment that was torn by a crash. Messages are formatted the same
+	// way as fmt.Printf. Nothing is logged while reading values unless it is at the debug level.
+	Logger interface {
+		// Debugf is used for detailed messages that are only useful when diagnosing a problem.
+		Debugf(format string, args ...interface{})
+
+		// Infof is used for normal events such as a WAL segment being rotated.
+		Infof(format string, args ...interface{})
+
+		// Warnf is used when something went wrong but the database was able to continue, such as
+		// a torn transaction being truncated from a WAL segment.
+		Warnf(format string, args ...interface{})
+
+		// Errorf is used when something went wrong that could not be returned to a caller.
+		Errorf(format string, args ...interface{})
+	}
+
+	// noopLogger is a Logger that discards every message. This is used when no Logger is
+	// provided.
+	noopLogger struct{}
+)
+
+var (
+	_ Logger = noopLogger{}
+)
+
+func (noopLogger) Debugf(format string, args ...interface{}) {}
+
+func (noopLogger) Infof(format string, args ...interface{}) {}
+
+func (noopLogger) Warnf(format string, args ...interface{}) {}
+
+func (noopLogger) Errorf(format string, args ...interface{}) {}
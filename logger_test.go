@@ -0,0 +1,111 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// capturingLogger keeps every message that is logged, prefixed with its level.
+type capturingLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (l *capturingLogger) log(level, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) Debugf(format string, args ...interface{}) {
+	l.log("debug", format, args...)
+}
+
+func (l *capturingLogger) Infof(format string, args ...interface{}) {
+	l.log("info", format, args...)
+}
+
+func (l *capturingLogger) Warnf(format string, args ...interface{}) {
+	l.log("warn", format, args...)
+}
+
+func (l *capturingLogger) Errorf(format string, args ...interface{}) {
+	l.log("error", format, args...)
+}
+
+// Messages returns every message that has been logged so far and clears them.
+func (l *capturingLogger) Messages() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	messages := l.messages
+	l.messages = nil
+	return messages
+}
+
+func TestLogger(t *testing.T) {
+	t.Run("flush and rotate", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		logger := &capturingLogger{}
+		options := DefaultOptions()
+		options.Directory = dir
+		options.Logger = logger
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		result := make(chan error, 1)
+		assert.NoError(t, db.enqueue(walTransaction{
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: []byte("value"),
+				},
+			},
+		}, result))
+		assert.NoError(t, <-result)
+		assert.Equal(t, []string{"info started wal segment 1"}, logger.Messages())
+
+		assert.NoError(t, db.Flush())
+		assert.Equal(t, []string{"info flushed the wal and value files to the disk"}, logger.Messages())
+
+		_, err = db.RotateWAL()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"info started wal segment 2"}, logger.Messages())
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// Append to a segment without ever syncing it so that the free space stored in the file
+		// is behind the transactions.
+		segment, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		for i := uint64(1); i <= 3; i++ {
+			assert.NoError(t, segment.Append(walTransaction{TransactionId: i}))
+		}
+		empty := newFreeSpace(1024)
+		_, err = segment.File.WriteAt(empty.Encode(), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, segment.Close())
+
+		logger := &capturingLogger{}
+		manager, err := newWalManager(dir, 1024, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		manager.Logger = logger
+
+		lastTransaction, ok, err := manager.LastTransaction()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(3), lastTransaction.TransactionId)
+		assert.Equal(t, []string{
+			"warn recovered wal segment 1, 3 transactions are intact",
+		}, logger.Messages())
+	})
+}
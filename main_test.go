@@ -4,6 +4,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -24,3 +26,146 @@ func NewTempDirectory(t assert.TestingT) (string, func()) {
 		os.RemoveAll(dir)
 	}
 }
+
+// faultyFile wraps a ReaderWriterAt and can be told to fail writes and syncs. Each queued error is
+// returned once, in order, before calls are passed through to the underlying file again.
+type faultyFile struct {
+	ReaderWriterAt
+
+	lock        sync.Mutex
+	writeErrors []error
+	syncErrors  []error
+
+	// Writes is the number of writes that made it to the underlying file.
+	Writes int
+
+	// BytesRead is the total number of bytes that have been read from the underlying file.
+	BytesRead int
+}
+
+func newFaultyFile(file ReaderWriterAt) *faultyFile {
+	return &faultyFile{
+		ReaderWriterAt: file,
+	}
+}
+
+// FailWrites will queue errors to be returned from the next calls to WriteAt. A nil error lets
+// that call through to the underlying file.
+func (f *faultyFile) FailWrites(errs ...error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.writeErrors = append(f.writeErrors, errs...)
+}
+
+// FailSyncs will queue errors to be returned from the next calls to Sync.
+func (f *faultyFile) FailSyncs(errs ...error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.syncErrors = append(f.syncErrors, errs...)
+}
+
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	if len(f.writeErrors) > 0 {
+		err := f.writeErrors[0]
+		f.writeErrors = f.writeErrors[1:]
+		if err != nil {
+			f.lock.Unlock()
+			return 0, err
+		}
+	}
+	f.Writes++
+	f.lock.Unlock()
+
+	return f.ReaderWriterAt.WriteAt(p, off)
+}
+
+func (f *faultyFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.ReaderWriterAt.ReadAt(p, off)
+	f.lock.Lock()
+	f.BytesRead += n
+	f.lock.Unlock()
+
+	return n, err
+}
+
+func (f *faultyFile) Sync() error {
+	f.lock.Lock()
+	if len(f.syncErrors) > 0 {
+		err := f.syncErrors[0]
+		f.syncErrors = f.syncErrors[1:]
+		f.lock.Unlock()
+		return err
+	}
+	f.lock.Unlock()
+
+	if canSync, ok := f.ReaderWriterAt.(CanSync); ok {
+		return canSync.Sync()
+	}
+
+	return nil
+}
+
+func (f *faultyFile) Close() error {
+	if closer, ok := f.ReaderWriterAt.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// manualWriter is a database whose background writer is only run when the test calls Step, so a
+// test can decide exactly when each queued commit, drain or close is handled.
+type manualWriter struct {
+	*DB
+}
+
+// newDBForTest will open the database without starting its background writer.
+func newDBForTest(t assert.TestingT, options Options) *manualWriter {
+	db, err := open(options)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	return &manualWriter{
+		DB: db,
+	}
+}
+
+// Step will handle the next item sent to the background writer, waiting for one if nothing has
+// been sent yet. It returns false once the writer has been stopped.
+func (w *manualWriter) Step() bool {
+	return w.DB.step()
+}
+
+// WaitForQueued will wait until at least n items are waiting for the background writer. This is
+// used when something is sent from another goroutine, such as a Drain that blocks until handled.
+func (w *manualWriter) WaitForQueued(n int) {
+	for len(w.DB.writeChannel) < n {
+		runtime.Gosched()
+	}
+}
+
+// Close will close the database, running the background writer until it has been stopped.
+func (w *manualWriter) Close() error {
+	result := make(chan error, 1)
+	go func() {
+		result <- w.DB.Close()
+	}()
+
+	for w.Step() {
+	}
+
+	return <-result
+}
+
+// isDone returns true if a result has been sent on the channel, without waiting for one.
+func isDone(result chan error) bool {
+	select {
+	case err := <-result:
+		result <- err
+		return true
+	default:
+		return false
+	}
+}
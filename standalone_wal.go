@@ -0,0 +1,182 @@
+package lsmtree
+
+import (
+	"crypto/cipher"
+	"sync"
+)
+
+type (
+	// WALOptions is used to configure a standalone WAL.
+	WALOptions struct {
+		// Directory is the folder where WAL segment files will be stored.
+		// Default is wal.
+		Directory string
+
+		// MaxSegmentSize (in bytes) is the largest a single WAL segment file will grow to before a
+		// new segment is started (see Options.MaxWALSegmentSize).
+		// Default is 8kb.
+		MaxSegmentSize uint64
+
+		// PreallocSize (in bytes) is the size that new WAL segment files are created with (see
+		// Options.WALPreallocSize).
+		// Default is 0.
+		PreallocSize uint64
+
+		// DisableDirectorySync will skip syncing the directory after a new segment has been
+		// created (see Options.DisableDirectorySync).
+		// Default is false.
+		DisableDirectorySync bool
+
+		// WriteRetry is the policy used to retry writes to WAL segments that fail with a transient
+		// error.
+		// Default is the same as DefaultOptions.
+		WriteRetry RetryPolicy
+
+		// Cipher is used to encrypt the transactions written to the WAL (see Options.Cipher).
+		// Default is nil.
+		Cipher cipher.AEAD
+	}
+
+	// WAL is a durable, append only log of transactions. It is the same write ahead log that is
+	// used by the DB, but without any of the key/value storage built on top of it. This can be used
+	// as a durable queue. You can open/create a WAL by calling OpenWAL().
+	WAL struct {
+		// lock is held while a transaction is being appended so that transaction ids are assigned
+		// in the same order that the transactions are written.
+		lock sync.Mutex
+
+		// lastTransactionId is the id of the last transaction appended to the WAL.
+		lastTransactionId uint64
+
+		manager *walManager
+	}
+
+	// WALChange is a single change within a WALTransaction.
+	WALChange struct {
+		// Delete is true if this change is a delete. Deletes do not store a value.
+		Delete bool
+
+		// Key is the key that is being changed.
+		Key []byte
+
+		// Value is the value being stored for the key. This will be nil if Delete is true.
+		Value []byte
+	}
+
+	// WALTransaction is a batch of changes that were appended to the WAL together.
+	WALTransaction struct {
+		// TransactionId is assigned when the transaction is appended. Transaction ids are always
+		// ascending in the order that they were appended.
+		TransactionId uint64
+
+		// Changes are the changes that were appended as part of the transaction.
+		Changes []WALChange
+	}
+)
+
+// DefaultWALOptions just provides a basic configuration which can be passed to open a WAL.
+func DefaultWALOptions() WALOptions {
+	options := DefaultOptions()
+	return WALOptions{
+		Directory:      "wal",
+		MaxSegmentSize: options.MaxWALSegmentSize,
+		WriteRetry:     options.WriteRetry,
+	}
+}
+
+// OpenWAL will open or create a standalone WAL in the directory specified. If the WAL already has
+// transactions then new transactions will continue from the last transaction id.
+func OpenWAL(options WALOptions) (*WAL, error) {
+	manager, err := newWalManager(
+		options.Directory, options.MaxSegmentSize, options.PreallocSize, options.WriteRetry,
+		!options.DisableDirectorySync,
+	)
+	if err != nil {
+		return nil, err
+	}
+	manager.Cipher = options.Cipher
+
+	// Find the last transaction id so we know where to continue from. This only reads the segment
+	// headers, so opening a large WAL does not have to read every transaction.
+	lastTransactionId, _, err := manager.LastTransactionId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WAL{
+		manager:           manager,
+		lastTransactionId: lastTransactionId,
+	}, nil
+}
+
+// Append will write the changes to the WAL as a single transaction and return the transaction id
+// that was assigned to it. The transaction is not durable until Sync is called.
+func (w *WAL) Append(changes ...WALChange) (transactionId uint64, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	txn := walTransaction{
+		TransactionId: w.lastTransactionId + 1,
+		Entries:       make([]walTransactionChange, len(changes)),
+	}
+	for i, change := range changes {
+		txn.Entries[i] = walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   change.Key,
+			Value: change.Value,
+		}
+		if change.Delete {
+			txn.Entries[i].Type = walTransactionChangeTypeDelete
+			txn.Entries[i].Value = nil
+		}
+	}
+
+	if err = w.manager.Append(txn); err != nil {
+		return 0, err
+	}
+
+	w.lastTransactionId = txn.TransactionId
+
+	return txn.TransactionId, nil
+}
+
+// Sync will flush every transaction appended so far to the disk.
+func (w *WAL) Sync() error {
+	return w.manager.Sync()
+}
+
+// ReadFrom will call fn with every transaction whose id is greater than or equal to the id
+// provided, in the order that they were appended. If fn returns an error then reading will stop
+// and the error will be returned.
+func (w *WAL) ReadFrom(transactionId uint64, fn func(txn WALTransaction) error) error {
+	itr, err := w.manager.ReadFrom(transactionId)
+	if err != nil {
+		return err
+	}
+
+	for ; itr.Valid(); itr.Next() {
+		txn := itr.Transaction()
+		result := WALTransaction{
+			TransactionId: txn.TransactionId,
+			Changes:       make([]WALChange, len(txn.Entries)),
+		}
+		for i, entry := range txn.Entries {
+			result.Changes[i] = WALChange{
+				Delete: entry.Type == walTransactionChangeTypeDelete,
+				Key:    entry.Key,
+				Value:  entry.Value,
+			}
+		}
+
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+
+	return itr.Err()
+}
+
+// Close will sync and close the WAL.
+func (w *WAL) Close() error {
+	return w.manager.Close()
+}
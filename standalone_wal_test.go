@@ -0,0 +1,128 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOpenWAL(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultWALOptions()
+		options.Directory = dir
+
+		wal, err := OpenWAL(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, wal)
+
+		err = wal.Close()
+		assert.NoError(t, err)
+	})
+}
+
+func TestWAL_Append(t *testing.T) {
+	t.Run("append and replay", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultWALOptions()
+		options.Directory = dir
+		options.MaxSegmentSize = 256
+
+		wal, err := OpenWAL(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, wal)
+
+		// Append enough transactions that they span several segments.
+		numberOfTransactions := 50
+		for i := 0; i < numberOfTransactions; i++ {
+			transactionId, err := wal.Append(WALChange{
+				Key:   []byte(fmt.Sprintf("key%d", i)),
+				Value: []byte(fmt.Sprintf("value%d", i)),
+			}, WALChange{
+				Delete: true,
+				Key:    []byte(fmt.Sprintf("old%d", i)),
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(i+1), transactionId)
+		}
+		assert.NoError(t, wal.Sync())
+		assert.NoError(t, wal.Close())
+
+		segmentIds, err := getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+		assert.True(t, len(segmentIds) > 1)
+
+		// Nothing but the WAL should have been written to the directory.
+		assert.Empty(t, mustGetFileIds(t, dir, FileTypeValue))
+
+		wal, err = OpenWAL(options)
+		assert.NoError(t, err)
+		defer wal.Close()
+
+		i := 0
+		err = wal.ReadFrom(0, func(txn WALTransaction) error {
+			assert.Equal(t, uint64(i+1), txn.TransactionId)
+			assert.Equal(t, []WALChange{
+				{
+					Key:   []byte(fmt.Sprintf("key%d", i)),
+					Value: []byte(fmt.Sprintf("value%d", i)),
+				},
+				{
+					Delete: true,
+					Key:    []byte(fmt.Sprintf("old%d", i)),
+				},
+			}, txn.Changes)
+			i++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, numberOfTransactions, i)
+
+		// New transactions should continue from where the WAL left off.
+		transactionId, err := wal.Append(WALChange{
+			Key:   []byte("key"),
+			Value: []byte("value"),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(numberOfTransactions+1), transactionId)
+	})
+
+	t.Run("read from a transaction id", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultWALOptions()
+		options.Directory = dir
+		options.MaxSegmentSize = 256
+
+		wal, err := OpenWAL(options)
+		assert.NoError(t, err)
+		defer wal.Close()
+
+		for i := 0; i < 20; i++ {
+			_, err := wal.Append(WALChange{
+				Key:   []byte("key"),
+				Value: []byte("value"),
+			})
+			assert.NoError(t, err)
+		}
+
+		ids := make([]uint64, 0)
+		err = wal.ReadFrom(15, func(txn WALTransaction) error {
+			ids = append(ids, txn.TransactionId)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{15, 16, 17, 18, 19, 20}, ids)
+	})
+}
+
+func mustGetFileIds(t *testing.T, directory string, kind FileType) []uint64 {
+	ids, err := getFileIds(directory, kind)
+	assert.NoError(t, err)
+	return ids
+}
@@ -0,0 +1,166 @@
+package lsmtree
+
+import (
+	"sync"
+)
+
+type (
+	// subscriber receives every transaction committed to the database after it was registered.
+	// Transactions are queued by the background writer and delivered by a goroutine for each
+	// subscriber so that a slow handler never blocks commits.
+	subscriber struct {
+		lock    sync.Mutex
+		pending []walTransaction
+
+		// notify is signaled whenever a transaction is added to pending.
+		notify chan struct{}
+
+		// done is closed when the subscription is cancelled.
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+)
+
+// Subscribe will call fn with every transaction with an id greater than or equal to fromTxnId.
+// Transactions that have already been committed are read from the WAL first, then newly committed
+// transactions are delivered as they are written. Each transaction is delivered exactly once and
+// in the order that it was committed. Delivery stops once cancel is called, fn returns an error or
+// the database is closed. fn is called from a background goroutine and will not be called again
+// after cancel has been called, unless a call to fn was already in progress. If reading the
+// committed transactions from the WAL fails part way through then the error is reported to
+// Options.Logger and delivery stops, every transaction delivered before that was still in order.
+// Newly committed transactions are queued in memory until fn has handled the ones before them,
+// there is no limit on that queue. A handler that cannot keep up with commits will keep growing
+// it until it catches up or the subscription is cancelled. If the database has been closed then
+// ErrDBClosed is returned.
+func (db *DB) Subscribe(
+	fromTxnId uint64, fn func(walTransaction) error,
+) (cancel func(), err error) {
+	sub := &subscriber{
+		pending: make([]walTransaction, 0),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	// The subscriber must be registered before the WAL is read. Anything committed before this
+	// point will be in the WAL, anything committed after this point will be queued. Transactions
+	// that are both in the WAL and queued are skipped the second time.
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	db.subscribersLock.Lock()
+	db.subscribers[sub] = struct{}{}
+	db.subscribersLock.Unlock()
+
+	itr, err := db.wal.ReadFrom(fromTxnId)
+	if err != nil {
+		db.unsubscribe(sub)
+		return nil, err
+	}
+
+	go func() {
+		defer db.unsubscribe(sub)
+
+		next := fromTxnId
+		deliver := func(txn walTransaction) bool {
+			if txn.TransactionId < next {
+				return true
+			}
+
+			select {
+			case <-sub.done:
+				return false
+			default:
+			}
+
+			if fn(txn) != nil {
+				return false
+			}
+
+			next = txn.TransactionId + 1
+			return true
+		}
+
+		for ; itr.Valid(); itr.Next() {
+			if !deliver(itr.Transaction()) {
+				return
+			}
+		}
+
+		if err := itr.Err(); err != nil {
+			db.logger.Errorf(
+				"subscriber stopped at transaction %d, could not read the wal: %v", next, err,
+			)
+			return
+		}
+
+		for {
+			select {
+			case <-sub.done:
+				return
+			case <-sub.notify:
+			}
+
+			sub.lock.Lock()
+			transactions := sub.pending
+			sub.pending = make([]walTransaction, 0)
+			sub.lock.Unlock()
+
+			for _, txn := range transactions {
+				if !deliver(txn) {
+					return
+				}
+			}
+		}
+	}()
+
+	return sub.cancel, nil
+}
+
+// publish will queue the transaction for every subscriber. This is called by the background
+// writer after the transaction has been written to the WAL.
+func (db *DB) publish(txn walTransaction) {
+	db.subscribersLock.Lock()
+	defer db.subscribersLock.Unlock()
+
+	for sub := range db.subscribers {
+		sub.lock.Lock()
+		sub.pending = append(sub.pending, txn)
+		sub.lock.Unlock()
+
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unsubscribe will cancel the subscriber and stop queueing transactions for it.
+func (db *DB) unsubscribe(sub *subscriber) {
+	sub.cancel()
+
+	db.subscribersLock.Lock()
+	delete(db.subscribers, sub)
+	db.subscribersLock.Unlock()
+}
+
+// cancelSubscribers will cancel every subscriber. This is called when the database is closed.
+func (db *DB) cancelSubscribers() {
+	db.subscribersLock.Lock()
+	defer db.subscribersLock.Unlock()
+
+	for sub := range db.subscribers {
+		sub.cancel()
+	}
+}
+
+// cancel will stop delivering transactions to the subscriber. It is safe to call cancel more than
+// once.
+func (s *subscriber) cancel() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,229 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_Subscribe(t *testing.T) {
+	newDB := func(t *testing.T) (*DB, func()) {
+		dir, cleanup := NewTempDirectory(t)
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.PendingWritesBuffer = 16
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		return db, func() {
+			assert.NoError(t, db.Close())
+			cleanup()
+		}
+	}
+
+	commit := func(db *DB, from, to int) {
+		for i := from; i <= to; i++ {
+			db.enqueue(walTransaction{
+				TransactionId: uint64(i),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key"),
+						Value: []byte("value"),
+					},
+				},
+			}, nil)
+		}
+	}
+
+	// collector records the transaction ids delivered to a subscriber.
+	type collector struct {
+		lock sync.Mutex
+		ids  []uint64
+	}
+
+	handler := func(c *collector, until int, done chan struct{}) func(walTransaction) error {
+		return func(txn walTransaction) error {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			c.ids = append(c.ids, txn.TransactionId)
+			if len(c.ids) == until {
+				close(done)
+			}
+			return nil
+		}
+	}
+
+	expected := func(from, to int) []uint64 {
+		ids := make([]uint64, 0)
+		for i := from; i <= to; i++ {
+			ids = append(ids, uint64(i))
+		}
+		return ids
+	}
+
+	t.Run("historical then live", func(t *testing.T) {
+		db, cleanup := newDB(t)
+		defer cleanup()
+
+		commit(db, 1, 50)
+		assert.NoError(t, db.Drain())
+
+		// Keep committing while the subscriber is created so that some transactions are committed
+		// right at the handoff from the WAL to live delivery.
+		committed := make(chan struct{})
+		go func() {
+			defer close(committed)
+			commit(db, 51, 100)
+		}()
+
+		c, done := &collector{}, make(chan struct{})
+		cancel, err := db.Subscribe(1, handler(c, 100, done))
+		assert.NoError(t, err)
+		defer cancel()
+
+		<-committed
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for transactions")
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		assert.Equal(t, expected(1, 100), c.ids)
+	})
+
+	t.Run("from the middle", func(t *testing.T) {
+		db, cleanup := newDB(t)
+		defer cleanup()
+
+		commit(db, 1, 20)
+		assert.NoError(t, db.Drain())
+
+		c, done := &collector{}, make(chan struct{})
+		cancel, err := db.Subscribe(11, handler(c, 20, done))
+		assert.NoError(t, err)
+		defer cancel()
+
+		commit(db, 21, 30)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for transactions")
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		assert.Equal(t, expected(11, 30), c.ids)
+	})
+
+	t.Run("cancel and errors stop delivery", func(t *testing.T) {
+		db, cleanup := newDB(t)
+		defer cleanup()
+
+		commit(db, 1, 5)
+		assert.NoError(t, db.Drain())
+
+		cancelled, cancelledDone := &collector{}, make(chan struct{})
+		cancel, err := db.Subscribe(1, handler(cancelled, 5, cancelledDone))
+		assert.NoError(t, err)
+
+		failed := &collector{}
+		_, err = db.Subscribe(1, func(txn walTransaction) error {
+			failed.lock.Lock()
+			defer failed.lock.Unlock()
+			failed.ids = append(failed.ids, txn.TransactionId)
+			if txn.TransactionId == 3 {
+				return errors.New("stop")
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+
+		<-cancelledDone
+		cancel()
+
+		commit(db, 6, 10)
+		assert.NoError(t, db.Drain())
+
+		// Give the subscribers a moment in case they would (incorrectly) still receive anything.
+		time.Sleep(10 * time.Millisecond)
+
+		cancelled.lock.Lock()
+		assert.Equal(t, expected(1, 5), cancelled.ids)
+		cancelled.lock.Unlock()
+
+		failed.lock.Lock()
+		assert.Equal(t, expected(1, 3), failed.ids)
+		failed.lock.Unlock()
+
+		db.subscribersLock.Lock()
+		assert.Empty(t, db.subscribers)
+		db.subscribersLock.Unlock()
+	})
+
+	t.Run("wal read error", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		logger := &capturingLogger{}
+		options := DefaultOptions()
+		options.Directory = dir
+		options.Logger = logger
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		commit(db, 1, 5)
+		assert.NoError(t, db.Drain())
+		_, err = db.RotateWAL()
+		assert.NoError(t, err)
+		commit(db, 6, 10)
+		assert.NoError(t, db.Drain())
+		logger.Messages()
+
+		// Corrupt a transaction in the second segment so that the history can only be read up to
+		// the end of the first segment.
+		assert.NoError(t, db.wal.withSegment(2, func(segment *walSegment) error {
+			ok, start, end, err := segment.getTransactionDataLocation(8)
+			assert.True(t, ok)
+			if err != nil {
+				return err
+			}
+			_, err = segment.File.WriteAt(make([]byte, end-start), start)
+			return err
+		}))
+
+		c := &collector{}
+		_, err = db.Subscribe(1, handler(c, 10, make(chan struct{})))
+		assert.NoError(t, err)
+
+		stopped := func() bool {
+			db.subscribersLock.Lock()
+			defer db.subscribersLock.Unlock()
+			return len(db.subscribers) == 0
+		}
+		for deadline := time.Now().Add(5 * time.Second); !stopped(); {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the subscriber to stop")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		c.lock.Lock()
+		assert.Equal(t, expected(1, 5), c.ids)
+		c.lock.Unlock()
+
+		messages := logger.Messages()
+		if assert.Len(t, messages, 1) {
+			assert.Contains(t, messages[0], "error subscriber stopped at transaction 6")
+		}
+	})
+}
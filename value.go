@@ -1,9 +1,13 @@
 package lsmtree
 
 import (
+	"container/list"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/fnv"
+	"io"
 	"os"
 	"path"
 	"sync"
@@ -16,6 +20,11 @@ var (
 	// as an indicator of file corruption.
 	ErrBadValueChecksum = errors.New("bad value checksum")
 
+	// ErrValueChecksumIgnored is returned along with the value read when the value's checksum does
+	// not match, but checksum errors are being ignored. The value returned might be corrupt, and
+	// it is the bytes that were stored for the value, it has not been decoded by the ValueCodec.
+	ErrValueChecksumIgnored = errors.New("bad value checksum ignored")
+
 	// ErrBrokenValue is returned when the entire value could not be read from from the value file.
 	// Or when the entire value could not be written to the file.
 	ErrIncompleteValue = errors.New("incomplete value")
@@ -23,9 +32,58 @@ var (
 	// ErrCreatingChecksum is returned when a value is being written to the value file but the
 	// checksum could not be created.
 	ErrCreatingChecksum = errors.New("could not create checksum for value")
+
+	// ErrValueSizeMismatch is returned when a value is read with a size that does not match the
+	// length header stored in front of the value in the value file.
+	ErrValueSizeMismatch = errors.New("value size does not match stored length")
+
+	// ErrBadValueLocator is returned when an encoded ValueLocator is truncated or has extra bytes.
+	ErrBadValueLocator = errors.New("bad value locator")
+)
+
+const (
+	// valueHeaderSize is the number of bytes that prefix every value in a value file. The header
+	// stores the length of the value so that the file can be scanned without any outside
+	// knowledge of the values stored in it.
+	valueHeaderSize = 4
+
+	// valueChecksumSize is the number of bytes that suffix every value in a value file. This is
+	// the 32-bit fnv checksum of the value.
+	valueChecksumSize = 4
 )
 
 type (
+	// ValueCodec is used to transform values before they are written to the value files, and to
+	// reverse the transformation when they are read back. The key that the value belongs to is
+	// provided so that the transformation can depend on the key, such as only compressing values
+	// under a certain prefix. The checksum of each value is calculated over the stored bytes that
+	// Encode returns.
+	ValueCodec interface {
+		// Name identifies the codec. The name is recorded when the database is created and the
+		// database can only be opened again with a codec of the same name. It must not be empty
+		// or contain a newline.
+		Name() string
+
+		// Encode returns the bytes that will be stored for the value.
+		Encode(key, value []byte) []byte
+
+		// Decode returns the original value from the bytes that were stored.
+		Decode(key, stored []byte) []byte
+	}
+
+	// ValueLocator is the address of a value in the value files. It is the fileId, offset and size
+	// returned when the value was written, which is everything needed to read the value back.
+	ValueLocator struct {
+		// FileId is the value file that the value was written to.
+		FileId uint64
+
+		// Offset is where the value's entry starts within the value file.
+		Offset uint64
+
+		// Size is the number of bytes that were stored for the value.
+		Size uint64
+	}
+
 	// valueManager wraps all of the value files and manages reads and writes of actual values.
 	valueManager struct {
 		// directory is the folder where all valueFiles will be stored.
@@ -39,13 +97,69 @@ type (
 		// file map. To modify the files map, a readLock and writeLock must be held.
 		readLock sync.RWMutex
 
-		// files is just a map of all of the valueFiles in memory by their fileId.
+		// files is just a map of all of the valueFiles in memory by their fileId. Files that are
+		// not in this map are not open and will be reopened from the disk when they are needed.
 		files map[uint64]*valueFile
+
+		// maxValueChunkSize is the largest a single value file is allowed to grow to excluding the
+		// last value written to it. (see Options)
+		maxValueChunkSize uint64
+
+		// maxOpenFiles is the maximum number of value file handles that will be kept open at
+		// once. If this is 0 then there is no limit. (see Options)
+		maxOpenFiles int
+
+		// currentFileId is the value file that new values are being written to. This file is
+		// never evicted.
+		currentFileId uint64
+
+		// recoverFileId is the last value file that existed when the manager was created. Values
+		// might have been partially written to the end of it, so it is recovered the first time
+		// it is opened. (see valueFile.Recover) This is 0 once it has been recovered.
+		recoverFileId uint64
+
+		// lruLock protects the lru list. It can be acquired while holding either the readLock
+		// or the writeLock.
+		lruLock sync.Mutex
+
+		// lru keeps track of the order that files were last used with the most recently used file
+		// at the front of the list. The values of the list are the fileIds.
+		lru *list.List
+
+		// openFiles is the number of value file handles that are currently open. This includes
+		// files that have been evicted but still have references.
+		openFiles int64
+
+		// retry is the policy used for writes to the value files that are opened. (see Options)
+		retry RetryPolicy
+
+		// cipher is used to encrypt values when it is not nil. (see Options)
+		cipher cipher.AEAD
+
+		// ignoreChecksumErrors will return values with a bad checksum instead of failing to read
+		// them. (see Options)
+		ignoreChecksumErrors bool
+
+		// disableChecksums will store values without a checksum. (see Options)
+		disableChecksums bool
+
+		// shardDepth is the number of levels of subdirectories that value files are spread
+		// across within the directory. (see Options)
+		shardDepth int
+
+		// codec is used to transform values before they are stored and after they are read when
+		// it is not nil. (see Options)
+		codec ValueCodec
+
+		// syncDirectory is true if the directory should be synced after a new value file is
+		// created. (see Options)
+		syncDirectory bool
 	}
 
 	// valueFile represents an append only file that is used to store actual values for the
-	// database. Each file is a chunk of the total database file and contains an array of twe types
-	// of data. The value itself (which is stored as a raw byte array) and a checksum for the value.
+	// database. Each file is a chunk of the total database file and contains an array of entries.
+	// Each entry is a 4 byte length header, the value itself (which is stored as a raw byte array)
+	// and a checksum for the value.
 	valueFile struct {
 		// FileId represents a unique identifier for this file. The id is globally unique and will
 		// not collide with any other value files.
@@ -63,19 +177,461 @@ type (
 		// fast concurrent writes. Right now this is an os.File but this could be replaced if it
 		// ever needed to be.
 		File ReaderWriterAt
+
+		// Retry is the policy used when a write to the file fails with a transient error. The
+		// zero value of the policy will not retry writes.
+		Retry RetryPolicy
+
+		// Cipher is used to encrypt every entry in the file when it is not nil. The value and its
+		// checksum are sealed together, the length header is not encrypted.
+		Cipher cipher.AEAD
+
+		// IgnoreChecksumErrors will make Read return values whose checksum does not match along
+		// with ErrValueChecksumIgnored rather than failing with ErrBadValueChecksum. Iterate will
+		// skip these values.
+		IgnoreChecksumErrors bool
+
+		// DisableChecksums will write entries without a checksum and skip validating the checksum
+		// when values are read. A file must always be read with the same setting it was written
+		// with.
+		DisableChecksums bool
+
+		// references is the number of callers that have acquired this file from the valueManager
+		// and have not released it yet. A file that has been evicted will not be closed until all
+		// of its references have been released.
+		references int64
+
+		// evicted is set to 1 once the file has been removed from the valueManager. Once it is set
+		// the file will be closed when the last reference is released.
+		evicted int32
+
+		// closed is set to 1 by the valueManager once it has closed the file. This is used to keep
+		// track of the number of open files.
+		closed int32
+
+		// closeOnce makes sure that the underlying file is only closed once, even if the eviction
+		// and the last release happen at the same time.
+		closeOnce sync.Once
+
+		// closeErr is the result of closing the underlying file.
+		closeErr error
+
+		// lruElement is this file's position in the valueManager's lru list.
+		lruElement *list.Element
+	}
+
+	// ValueHandle is a value that has been borrowed from a value file. The value is backed by a
+	// pooled buffer that is reused once the handle is released. (see valueFile.Borrow)
+	ValueHandle struct {
+		value  []byte
+		buffer *[]byte
 	}
 )
 
+var (
+	// valueBufferPool holds the buffers that values are borrowed into. (see valueFile.Borrow)
+	valueBufferPool = sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, 0, 4096)
+			return &buffer
+		},
+	}
+)
+
+// newValueManager will create the value manager object. The directory provided will be created
+// if it does not already exist. New values will be written to the value file with the highest id
+// that already exists in the directory, or to a new value file if there are none.
+func newValueManager(
+	directory string, maxValueChunkSize uint64, maxOpenFiles int, retry RetryPolicy,
+	syncDirectory bool,
+) (*valueManager, error) {
+	// Create/verify that the directory exists. If it does not exist then this will create it. If
+	// the dir does exist then nothing will happen here.
+	if err := newDirectory(directory); err != nil {
+		return nil, err
+	}
+
+	fileIds, err := getFileIds(directory, FileTypeValue)
+	if err != nil {
+		return nil, err
+	}
+
+	// File ids start at 1, a fileId of 0 means that the value has not been written to a file.
+	currentFileId, recoverFileId := uint64(1), uint64(0)
+	if len(fileIds) > 0 {
+		currentFileId = fileIds[len(fileIds)-1]
+		recoverFileId = currentFileId
+	}
+
+	return &valueManager{
+		directory:         directory,
+		files:             map[uint64]*valueFile{},
+		maxValueChunkSize: maxValueChunkSize,
+		maxOpenFiles:      maxOpenFiles,
+		currentFileId:     currentFileId,
+		recoverFileId:     recoverFileId,
+		lru:               list.New(),
+		retry:             retry,
+		syncDirectory:     syncDirectory,
+	}, nil
+}
+
+// skipTo will make sure that new values are never written to a value file with an id lower than
+// the one provided. This must be called before any values are written.
+func (m *valueManager) skipTo(fileId uint64) {
+	if m.currentFileId < fileId {
+		m.currentFileId = fileId
+	}
+}
+
+// Read will return the value stored in the value file specified at the offset provided. Size is
+// the number of bytes that were stored for the value, which is the size returned from Write. If
+// the value file is not currently open then it will be reopened from the disk. If there is a
+// codec then the value that was stored is decoded before it is returned. If the checksum of the
+// value did not match but checksum errors are being ignored then the stored bytes are returned
+// as they are with ErrValueChecksumIgnored, they are never given to the codec since they might
+// not be something it can decode.
+func (m *valueManager) Read(key []byte, fileId, offset, size uint64) ([]byte, error) {
+	file, err := m.acquire(fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(file)
+
+	value, err := file.Read(offset, size)
+	if m.codec != nil && value != nil && err == nil {
+		value = m.codec.Decode(key, value)
+	}
+
+	return value, err
+}
+
+// ReadLocator is the same as Read, but the value is found with the locator provided.
+func (m *valueManager) ReadLocator(key []byte, locator ValueLocator) ([]byte, error) {
+	return m.Read(key, locator.FileId, locator.Offset, locator.Size)
+}
+
+// Encode returns the serialized form of the locator. The fileId, the offset and the size are each
+// stored as a uvarint, so a locator for a small value near the start of a file only takes a few
+// bytes.
+func (l ValueLocator) Encode() []byte {
+	data := make([]byte, binary.MaxVarintLen64*3)
+	n := binary.PutUvarint(data, l.FileId)
+	n += binary.PutUvarint(data[n:], l.Offset)
+	n += binary.PutUvarint(data[n:], l.Size)
+	return data[:n]
+}
+
+// Decode will read a locator that was serialized with Encode. If the data is not exactly one
+// encoded locator then ErrBadValueLocator is returned.
+func (l *ValueLocator) Decode(data []byte) error {
+	var locator ValueLocator
+	for _, field := range []*uint64{&locator.FileId, &locator.Offset, &locator.Size} {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrBadValueLocator
+		}
+
+		*field, data = value, data[n:]
+	}
+
+	if len(data) > 0 {
+		return ErrBadValueLocator
+	}
+
+	*l = locator
+	return nil
+}
+
+// Write will append the value to the current value file and return the fileId, the offset and the
+// size of the value which can be used to read it back. If there is a codec then the value is
+// encoded first and the size is of the encoded value. If the current value file has grown beyond
+// the max value chunk size then a new value file will be started for subsequent writes.
+func (m *valueManager) Write(key, value []byte) (fileId, offset, size uint64, err error) {
+	file, err := m.acquire(atomic.LoadUint64(&m.currentFileId))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer m.release(file)
+
+	stored := m.encode(key, value)
+	if offset, err = file.Write(stored); err != nil {
+		return 0, 0, 0, err
+	}
+
+	// If this write pushed the file over the limit then we want to move onto the next file. Only
+	// one writer will win the swap, so we will only ever move forward one file at a time.
+	if m.maxValueChunkSize > 0 && atomic.LoadUint64(&file.Offset) >= m.maxValueChunkSize {
+		atomic.CompareAndSwapUint64(&m.currentFileId, file.FileId, file.FileId+1)
+	}
+
+	return file.FileId, offset, uint64(len(stored)), nil
+}
+
+// encode returns the bytes that will be stored for the value. If there is no codec then this is
+// the value itself.
+func (m *valueManager) encode(key, value []byte) []byte {
+	if m.codec == nil {
+		return value
+	}
+
+	return m.codec.Encode(key, value)
+}
+
+// acquire will return the value file for the fileId specified with a reference held. The caller
+// must call release once it is done with the file. If the file is not open then it will be opened
+// from the disk. Only one goroutine will ever open a given file at a time. Only the current value
+// file is created if it does not exist, any other file that does not exist returns an
+// ErrOpeningFile error that wraps os.ErrNotExist.
+func (m *valueManager) acquire(fileId uint64) (*valueFile, error) {
+	// The fast path is that the file is already open, in which case we only need the read lock.
+	m.readLock.RLock()
+	file, ok := m.files[fileId]
+	if ok {
+		atomic.AddInt64(&file.references, 1)
+		m.touch(file)
+	}
+	m.readLock.RUnlock()
+
+	if ok {
+		return file, nil
+	}
+
+	// The file is not open. Acquire the write lock so that no other goroutine can be opening
+	// files at the same time. Another goroutine might have opened the file while we were waiting
+	// though, so we need to check the map again.
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	// We don't need the read lock to read the map here because all changes to the map require
+	// the write lock, which we are holding.
+	if file, ok = m.files[fileId]; !ok {
+		// Only the file that is being written to is created, reading any other file that does
+		// not exist should not leave an empty file (or shard directories) behind.
+		var err error
+		if fileId == atomic.LoadUint64(&m.currentFileId) {
+			file, err = m.openCurrent(fileId)
+		} else {
+			file, err = openExistingValueFile(getShardPath(m.directory, fileId, m.shardDepth), fileId)
+		}
+		if err != nil {
+			return nil, err
+		}
+		file.Retry = m.retry
+		file.Cipher = m.cipher
+		file.IgnoreChecksumErrors = m.ignoreChecksumErrors
+		file.DisableChecksums = m.disableChecksums
+
+		// Values that are partially written are removed from the end of the file before anything
+		// else is written to it. This is skipped if checksum errors are ignored, since the
+		// database is only being opened to salvage what it can and nothing should be removed.
+		if fileId == m.recoverFileId && !m.ignoreChecksumErrors {
+			if _, err = file.Recover(); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+
+			m.recoverFileId = 0
+		}
+		atomic.AddInt64(&m.openFiles, 1)
+	}
+
+	// We need the exclusive read lock to modify the map so that no readers are using it.
+	m.readLock.Lock()
+	m.files[fileId] = file
+	atomic.AddInt64(&file.references, 1)
+	m.touch(file)
+	m.readLock.Unlock()
+
+	// Now that we have opened a new file we might be over the limit of open files.
+	m.evictLeastRecentlyUsed()
+
+	return file, nil
+}
+
+// openCurrent will open the current value file, creating it and its shard directory if they do
+// not exist yet.
+func (m *valueManager) openCurrent(fileId uint64) (*valueFile, error) {
+	directory, err := getShardDirectory(m.directory, fileId, m.shardDepth, m.syncDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	return openValueFile(directory, fileId, m.syncDirectory)
+}
+
+// touch will move the file to the front of the lru list, adding it to the list if it is not
+// already in it.
+func (m *valueManager) touch(file *valueFile) {
+	m.lruLock.Lock()
+	defer m.lruLock.Unlock()
+
+	if file.lruElement == nil {
+		file.lruElement = m.lru.PushFront(file.FileId)
+	} else {
+		m.lru.MoveToFront(file.lruElement)
+	}
+}
+
+// evictLeastRecentlyUsed will evict the least recently used files until the number of files open
+// is within the maxOpenFiles limit. The current value file will never be evicted. The writeLock
+// must be held when this is called.
+func (m *valueManager) evictLeastRecentlyUsed() {
+	if m.maxOpenFiles <= 0 {
+		return
+	}
+
+	currentFileId := atomic.LoadUint64(&m.currentFileId)
+	for len(m.files) > m.maxOpenFiles {
+		// Find the least recently used file that is not the current file.
+		victim := uint64(0)
+		m.lruLock.Lock()
+		for element := m.lru.Back(); element != nil; element = element.Prev() {
+			if fileId := element.Value.(uint64); fileId != currentFileId {
+				victim = fileId
+				break
+			}
+		}
+		m.lruLock.Unlock()
+
+		// If the only file left is the current file then there is nothing else to evict.
+		if victim == 0 {
+			return
+		}
+
+		m.remove(victim)
+	}
+}
+
+// release will give up a reference to a value file that was returned from acquire. If the file
+// has been evicted and this was the last reference then the file will be closed.
+func (m *valueManager) release(file *valueFile) {
+	if atomic.AddInt64(&file.references, -1) == 0 && atomic.LoadInt32(&file.evicted) == 1 {
+		_ = m.close(file)
+	}
+}
+
+// evict will remove the value file from the in memory map of files and close it once there are
+// no more references to it. The next time the file is needed it will be reopened from the disk.
+func (m *valueManager) evict(fileId uint64) {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	m.remove(fileId)
+}
+
+// remove will take the value file out of the files map and the lru list, and will close the file
+// if there are no references to it. The writeLock must be held when this is called.
+func (m *valueManager) remove(fileId uint64) {
+	m.readLock.Lock()
+	file, ok := m.files[fileId]
+	delete(m.files, fileId)
+	m.readLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	m.lruLock.Lock()
+	m.lru.Remove(file.lruElement)
+	file.lruElement = nil
+	m.lruLock.Unlock()
+
+	atomic.StoreInt32(&file.evicted, 1)
+	if atomic.LoadInt64(&file.references) == 0 {
+		_ = m.close(file)
+	}
+}
+
+// close will sync and then close the value file and keep track of the number of files that are
+// open. It is safe to call this multiple times for the same file.
+func (m *valueManager) close(file *valueFile) error {
+	if !atomic.CompareAndSwapInt32(&file.closed, 0, 1) {
+		return file.Close()
+	}
+
+	atomic.AddInt64(&m.openFiles, -1)
+
+	// The file might have been written to since it was last synced. We don't want an eviction to
+	// lose the durability of those writes.
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Sync will flush all of the value files that are currently open to the disk. Value files are only
+// written to while they are open so this will make every value written so far durable.
+func (m *valueManager) Sync() error {
+	m.readLock.RLock()
+	files := make([]*valueFile, 0, len(m.files))
+	for _, file := range m.files {
+		atomic.AddInt64(&file.references, 1)
+		files = append(files, file)
+	}
+	m.readLock.RUnlock()
+
+	var err error
+	for _, file := range files {
+		if syncErr := file.Sync(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+		m.release(file)
+	}
+
+	return err
+}
+
+// Close will close all of the value files that are currently open.
+func (m *valueManager) Close() error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	m.readLock.Lock()
+	files := m.files
+	m.files = map[uint64]*valueFile{}
+	m.readLock.Unlock()
+
+	m.lruLock.Lock()
+	m.lru.Init()
+	m.lruLock.Unlock()
+
+	var err error
+	for _, file := range files {
+		file.lruElement = nil
+		atomic.StoreInt32(&file.evicted, 1)
+		if closeErr := m.close(file); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
 // openValueFile will open a value file with the Id specified. If the file does not exist it will
 // create the file. The file is opened with the append, create and read/write flags, and the append
-// and exclusive mode.
-func openValueFile(directory string, fileId uint64) (*valueFile, error) {
+// and exclusive mode. If the file is created and syncDirectory is true then the directory will be
+// synced so that the new file is durable.
+func openValueFile(directory string, fileId uint64, syncDirectory bool) (*valueFile, error) {
+	// We want to be able to read/write the file. If the file does not exist we want to create it.
+	return openValueFileWithFlags(directory, fileId, os.O_CREATE|os.O_RDWR, syncDirectory)
+}
+
+// openExistingValueFile is the same as openValueFile, except that the file is never created. If
+// the file does not exist then the error returned wraps os.ErrNotExist.
+func openExistingValueFile(directory string, fileId uint64) (*valueFile, error) {
+	return openValueFileWithFlags(directory, fileId, os.O_RDWR, false)
+}
+
+// openValueFileWithFlags will open the value file with the Id specified using the flags provided.
+func openValueFileWithFlags(
+	directory string, fileId uint64, flags int, syncDirectory bool,
+) (*valueFile, error) {
 	// Get an actual file path for the directory and the fileId specified.
 	filePath := path.Join(directory, getValueFileName(fileId))
 
-	// We want to be able to read/write the file. If the file does not exist we want to create it.
-	flags := os.O_CREATE | os.O_RDWR
-
 	// We are only appending to the file, and we want to be the only process with the file open.
 	// This might change later as it might prove to be more efficient to have a single writer and
 	// multiple readers for a single file.
@@ -84,14 +640,24 @@ func openValueFile(directory string, fileId uint64) (*valueFile, error) {
 	// Open/create the file with the flags and mode specified.
 	file, err := os.OpenFile(filePath, flags, mode)
 	if err != nil {
-		return nil, err
+		return nil, newFileError(ErrOpeningFile, err, "opening value file %d", fileId)
 	}
 
 	// If we somehow cannot read the stat for the file then something is very wrong. We need to do
 	// this because we need to know what offset to start with when appending to the file.
 	stat, err := file.Stat()
 	if err != nil {
-		return nil, err
+		_ = file.Close()
+		return nil, newFileError(ErrOpeningFile, err, "reading stat of value file %d", fileId)
+	}
+
+	// If the file is empty then it might have just been created. The file's directory entry is not
+	// durable until the directory itself has been synced.
+	if syncDirectory && stat.Size() == 0 {
+		if err = directorySyncer(directory); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
 	}
 
 	f := &valueFile{
@@ -103,100 +669,405 @@ func openValueFile(directory string, fileId uint64) (*valueFile, error) {
 	return f, nil
 }
 
-// Read will return the byte array for a value at the address provided. Values are suffixed with a
-// 32-bit checksum when they are written. If the checksum does not match when the value is read then
-// an ErrBadValueChecksum will be returned here. This is to prevent unintentionally using a value
-// that is corrupt. If the entire value cannot be read then an ErrIncompleteValue is returned.
-// To recover the value for either of these failures, the WAL entry for this item should be found
-// and replayed.
+// Recover will find the end of the last complete value in the file and remove anything after it,
+// such as a value that was only partially written when the database crashed. Entries are checked
+// from the start of the file, and the first entry that is cut short, fails its checksum or cannot
+// be decrypted is treated as the end of the file, along with everything after it. The number of
+// bytes that were removed is returned. This must only be used on the file that values were being
+// written to, a value that was corrupted in the middle of an older file would remove every value
+// after it. The WAL keeps the value of every set change, so any values that are removed are still
+// in the WAL.
+func (f *valueFile) Recover() (removed uint64, err error) {
+	end := atomic.LoadUint64(&f.Offset)
+	header := make([]byte, valueHeaderSize)
+	offset := uint64(0)
+	for end-offset >= valueHeaderSize {
+		if _, err := f.File.ReadAt(header, int64(offset)); err != nil {
+			return 0, newFileError(
+				ErrReadingFile, err, "reading value header at offset %d of value file %d",
+				offset, f.FileId,
+			)
+		}
+
+		size := uint64(binary.BigEndian.Uint32(header))
+		if f.entrySize(size) > end-offset {
+			break
+		}
+
+		if _, err := f.Read(offset, size); errors.Is(err, ErrReadingFile) {
+			return 0, err
+		} else if err != nil {
+			break
+		}
+
+		offset += f.entrySize(size)
+	}
+
+	if offset == end {
+		return 0, nil
+	}
+
+	if truncater, ok := f.File.(interface{ Truncate(int64) error }); ok {
+		if err := truncater.Truncate(int64(offset)); err != nil {
+			return 0, newFileError(
+				ErrWritingFile, err, "removing partial values from value file %d", f.FileId,
+			)
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+
+	atomic.StoreUint64(&f.Offset, offset)
+	return end - offset, nil
+}
+
+// Read will return the byte array for a value at the address provided. Values are prefixed with a
+// 32-bit length header and suffixed with a 32-bit checksum when they are written. If the length
+// header does not match the size provided then an ErrValueSizeMismatch will be returned. If the
+// checksum does not match when the value is read then an ErrBadValueChecksum will be returned here.
+// This is to prevent unintentionally using a value that is corrupt. If the entire value cannot be
+// read then an ErrIncompleteValue is returned. To recover the value for either of these failures,
+// the WAL entry for this item should be found and replayed.
 func (f *valueFile) Read(offset, size uint64) ([]byte, error) {
-	// We need an extra 4 bytes for the checksum
-	value := make([]byte, size+4)
+	// We need an extra 4 bytes for the length header and 4 bytes for the checksum, as well as room
+	// for the nonce and overhead of the cipher if the file is encrypted.
+	return f.read(make([]byte, f.entrySize(size)), offset, size)
+}
 
+// Borrow will read the value at the address provided the same way as Read, but into a buffer
+// taken from a pool rather than a new allocation. The bytes of the handle returned are only valid
+// until Release is called, after which the buffer will be reused by another read. Release must be
+// called exactly once for every handle returned, including when the value is returned along with
+// ErrValueChecksumIgnored. If any other error is returned then there is nothing to release.
+func (f *valueFile) Borrow(offset, size uint64) (ValueHandle, error) {
+	entrySize := f.entrySize(size)
+	buffer := valueBufferPool.Get().(*[]byte)
+	if uint64(cap(*buffer)) < entrySize {
+		*buffer = make([]byte, entrySize)
+	}
+
+	value, err := f.read((*buffer)[:entrySize], offset, size)
+	if err != nil && !errors.Is(err, ErrValueChecksumIgnored) {
+		valueBufferPool.Put(buffer)
+		return ValueHandle{}, err
+	}
+
+	return ValueHandle{
+		value:  value,
+		buffer: buffer,
+	}, err
+}
+
+// Bytes returns the value that was borrowed. The bytes must not be used after Release is called.
+func (h ValueHandle) Bytes() []byte {
+	return h.value
+}
+
+// Release will return the buffer backing the value to the pool so that it can be reused.
+func (h ValueHandle) Release() {
+	if h.buffer != nil {
+		valueBufferPool.Put(h.buffer)
+	}
+}
+
+// read will read the entry for the value at the address provided into the entry buffer, which
+// must be exactly the size of the entry. The value returned is a slice of the entry buffer.
+func (f *valueFile) read(entry []byte, offset, size uint64) ([]byte, error) {
 	// Read the value into the buffer at the specified offset.
 	// If there is a problem just return early.
-	if n, err := f.File.ReadAt(value, int64(offset)); err != nil {
-		return nil, err
-	} else if n != len(value) {
+	if n, err := f.File.ReadAt(entry, int64(offset)); err != nil {
+		return nil, newFileError(
+			ErrReadingFile, err, "reading value at offset %d of value file %d", offset, f.FileId,
+		)
+	} else if n != len(entry) {
 		// If we didn't get an error but the number of bytes read does not match the number of bytes
 		// that we were looking for then we need to return an error.
-		return nil, ErrIncompleteValue
+		return nil, fmt.Errorf(
+			"reading value at offset %d of value file %d: %w", offset, f.FileId, ErrIncompleteValue,
+		)
 	}
 
-	// Validate the checksum.
-	{
-		h := fnv.New32()
+	// If the length stored in the file does not match the size the caller is looking for then the
+	// locator the caller has is wrong, or the header is corrupt.
+	if storedSize := binary.BigEndian.Uint32(entry[:valueHeaderSize]); uint64(storedSize) != size {
+		return nil, fmt.Errorf(
+			"reading value at offset %d of value file %d: %w", offset, f.FileId, ErrValueSizeMismatch,
+		)
+	}
 
-		// If we fail to write the checksum from the value or if the entire value could not be
-		// written to the hash then we want to fail here and assume the checksum is bad.
-		if n, err := h.Write(value[:size]); err != nil || uint64(n) != size {
-			return nil, ErrBadValueChecksum
+	value := entry[valueHeaderSize:]
+	if f.Cipher != nil {
+		var err error
+		// The value is decrypted in place so that it stays within the entry buffer.
+		nonceSize := f.Cipher.NonceSize()
+		if value, err = openBlock(
+			f.Cipher, value[nonceSize:nonceSize], value, f.additionalData(entry, offset),
+		); err != nil {
+			return nil, fmt.Errorf(
+				"reading value at offset %d of value file %d: %w", offset, f.FileId, err,
+			)
 		}
 
-		// actualChecksum is the hash of the value we read from the file.
-		actualChecksum := h.Sum32()
+		// An empty value without a checksum decrypts to nil, but an empty value is never nil.
+		if value == nil {
+			value = []byte{}
+		}
+	}
 
-		// readChecksum is the hash of the value that was stored in the file.
-		readChecksum := binary.BigEndian.Uint32(value[size:])
+	if f.DisableChecksums {
+		return value[:size], nil
+	}
 
-		// If the checksums to not match then that means the checksum in the file is wrong, or the
-		// value stored in the file is wrong. Either way the value is very likely corrupted and to
-		// make sure a bad value is not read we should return an error.
-		if actualChecksum != readChecksum {
-			return nil, ErrBadValueChecksum
+	if err := validateValueChecksum(value, size); err != nil {
+		if f.IgnoreChecksumErrors && errors.Is(err, ErrBadValueChecksum) {
+			return value[:size], fmt.Errorf(
+				"reading value at offset %d of value file %d: %w",
+				offset, f.FileId, ErrValueChecksumIgnored,
+			)
 		}
+
+		return nil, fmt.Errorf(
+			"reading value at offset %d of value file %d: %w", offset, f.FileId, err,
+		)
 	}
 
 	return value[:size], nil
 }
 
-// Write will take a value and write it to the value file. It will suffix the value with a 32-bit
-// checksum that will be used to guarantee the value is not corrupt. The file is not synchronized
-// here and must be called manually.
+// Iterate will walk every entry in the value file from the beginning of the file, calling fn with
+// the offset of the entry, the size of the value and the value itself. Every entry's checksum is
+// validated before fn is called. If IgnoreChecksumErrors is set then entries with a bad checksum
+// are skipped instead of stopping iteration. If fn returns an error then iteration will stop and the
+// error will be returned. The value provided to fn should not be retained after fn returns.
+func (f *valueFile) Iterate(fn func(offset, size uint64, value []byte) error) error {
+	end := atomic.LoadUint64(&f.Offset)
+	header := make([]byte, valueHeaderSize)
+	for offset := uint64(0); offset < end; {
+		// Read the length header for the current entry so we know how much more to read.
+		if n, err := f.File.ReadAt(header, int64(offset)); err != nil {
+			return newFileError(
+				ErrReadingFile, err, "reading value header at offset %d of value file %d",
+				offset, f.FileId,
+			)
+		} else if n != len(header) {
+			return fmt.Errorf(
+				"reading value header at offset %d of value file %d: %w",
+				offset, f.FileId, ErrIncompleteValue,
+			)
+		}
+
+		size := uint64(binary.BigEndian.Uint32(header))
+
+		value, err := f.Read(offset, size)
+		switch {
+		case errors.Is(err, ErrValueChecksumIgnored):
+			// The length header was still intact so we can skip the corrupt value and continue
+			// with the next one.
+		case err != nil:
+			return err
+		default:
+			if err := fn(offset, size, value); err != nil {
+				return err
+			}
+		}
+
+		offset += f.entrySize(size)
+	}
+
+	return nil
+}
+
+// entrySize returns the total number of bytes that an entry for a value of the size provided takes
+// up in the file.
+func (f *valueFile) entrySize(size uint64) uint64 {
+	size += valueHeaderSize + uint64(cipherOverhead(f.Cipher))
+	if !f.DisableChecksums {
+		size += valueChecksumSize
+	}
+
+	return size
+}
+
+// additionalData returns the data that is authenticated along with an encrypted entry. This is the
+// length header of the entry as well as where the entry is stored, so an entry cannot be moved to
+// another location or given a different length without failing to decrypt.
+func (f *valueFile) additionalData(header []byte, offset uint64) []byte {
+	data := make([]byte, valueHeaderSize+16)
+	copy(data, header[:valueHeaderSize])
+	binary.BigEndian.PutUint64(data[valueHeaderSize:], f.FileId)
+	binary.BigEndian.PutUint64(data[valueHeaderSize+8:], offset)
+	return data
+}
+
+// validateValueChecksum will calculate the checksum of the first size bytes of the value provided
+// and compare it to the 4 byte checksum that immediately follows it. If the checksums do not match
+// then ErrBadValueChecksum is returned.
+func validateValueChecksum(value []byte, size uint64) error {
+	h := fnv.New32()
+
+	// If we fail to write the checksum from the value or if the entire value could not be
+	// written to the hash then we want to fail here and assume the checksum is bad.
+	if n, err := h.Write(value[:size]); err != nil || uint64(n) != size {
+		return ErrBadValueChecksum
+	}
+
+	// actualChecksum is the hash of the value we read from the file.
+	actualChecksum := h.Sum32()
+
+	// readChecksum is the hash of the value that was stored in the file.
+	readChecksum := binary.BigEndian.Uint32(value[size : size+valueChecksumSize])
+
+	// If the checksums to not match then that means the checksum in the file is wrong, or the
+	// value stored in the file is wrong. Either way the value is very likely corrupted and to
+	// make sure a bad value is not read we should return an error.
+	if actualChecksum != readChecksum {
+		return ErrBadValueChecksum
+	}
+
+	return nil
+}
+
+// Write will take a value and write it to the value file. It will prefix the value with a 32-bit
+// length header and suffix the value with a 32-bit checksum that will be used to guarantee the
+// value is not corrupt. The offset returned is the offset of the length header, which is what
+// should be passed to Read. A zero-length value is stored as just the header and the checksum, and
+// is read back as an empty slice that is not nil. The file is not synchronized here and must be
+// called manually.
 func (f *valueFile) Write(value []byte) (uint64, error) {
-	// We add 4 bytes to the total length of the value in order to properly add the checksum suffix.
-	size := uint64(len(value) + 4)
+	offsets, err := f.WriteBatch([][]byte{value})
+	if err != nil {
+		return 0, err
+	}
+
+	return offsets[0], nil
+}
+
+// WriteBatch is the same as Write except that all of the values are written to the file with a
+// single write. The space for the entire batch is allocated at once, so the values will be stored
+// next to each other in the order they were provided. The offset of each value is returned in the
+// same order. If the write fails then none of the values should be considered written.
+func (f *valueFile) WriteBatch(values [][]byte) ([]uint64, error) {
+	// We add 4 bytes for the length header and 4 bytes for the checksum suffix to the total length
+	// of each value, as well as the overhead of the cipher if the file is encrypted.
+	size := uint64(0)
+	for _, value := range values {
+		size += f.entrySize(uint64(len(value)))
+	}
 
-	// Increment the offset atomically for this new value, but then subtract this values total size
-	// so that we know the actual offset that we need to write it to and the offset we want to
+	// Increment the offset atomically for the whole batch, but then subtract the batch's total size
+	// so that we know the actual offset that we need to write it to and the offsets we want to
 	// return at the end.
 	// This should (in theory) allow for concurrent writes to the same file as the only thing that
 	// needs to be contested here is the offset value. I believe that the write function for files
 	// is thread-safe.
 	offset := atomic.AddUint64(&f.Offset, size) - size
 
-	h := fnv.New32()
+	// Build every entry in a single buffer; the length header, the value and then the checksum.
+	offsets := make([]uint64, len(values))
+	batch := make([]byte, 0, size)
+	for i, value := range values {
+		offsets[i] = offset + uint64(len(batch))
 
-	// Try to write the value provided to the fnv hash. If it fails then return the error given. But
-	// if there is no error and n != the length that should have been written then return an error
-	// indicating that a Checksum could not be created.
-	if n, err := h.Write(value); err != nil {
-		return 0, err
-	} else if n != len(value) {
-		return 0, ErrCreatingChecksum
+		var err error
+		if batch, err = f.appendEntry(batch, value, offsets[i]); err != nil {
+			return nil, err
+		}
 	}
 
-	checksum := h.Sum(nil)
+	// Write the batch to the file at the calculated offset. The space for the batch has already
+	// been allocated, so if the write needs to be retried it will be retried at the same offset.
+	n := 0
+	if err := f.Retry.Do(func() (err error) {
+		n, err = f.File.WriteAt(batch, int64(offset))
+		return err
+	}); err != nil {
+		// If the disk is full then give the space back so the offset is not left pointing past a
+		// hole in the file. This is only possible if no other value has been written since.
+		if isDiskFullError(err) {
+			atomic.CompareAndSwapUint64(&f.Offset, offset+size, offset)
+		}
 
-	v := append(value, checksum...)
-	// Write the value and checksum to the file at the calculated offset.
-	if n, err := f.File.WriteAt(v, int64(offset)); err != nil {
-		return 0, err
+		return nil, newFileError(
+			ErrWritingFile, err, "writing value at offset %d of value file %d", offset, f.FileId,
+		)
 	} else if uint64(n) != size {
-		return 0, ErrIncompleteValue
+		return nil, fmt.Errorf(
+			"writing value at offset %d of value file %d: %w", offset, f.FileId, ErrIncompleteValue,
+		)
 	}
 
-	// If everything has succeeded and the value has been written, then return the offset of the
-	// stored value.
-	return offset, nil
+	// If everything has succeeded and the values have been written, then return the offsets of the
+	// stored values.
+	return offsets, nil
+}
+
+// appendEntry will append the entry for the value to the buffer provided and return the buffer.
+// The offset is where the entry will be stored in the file, which is authenticated along with the
+// entry if the file is encrypted.
+func (f *valueFile) appendEntry(buf, value []byte, offset uint64) ([]byte, error) {
+	header := make([]byte, valueHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(len(value)))
+	buf = append(buf, header...)
+
+	// The checksum suffixes the value, unless checksums have been disabled in which case the entry
+	// is just the header and the value.
+	var checksum []byte
+	if !f.DisableChecksums {
+		h := fnv.New32()
+
+		// Try to write the value provided to the fnv hash. If it fails then return the error given.
+		// But if there is no error and n != the length that should have been written then return an
+		// error indicating that a Checksum could not be created.
+		if n, err := h.Write(value); err != nil {
+			return nil, err
+		} else if n != len(value) {
+			return nil, ErrCreatingChecksum
+		}
+
+		checksum = h.Sum(nil)
+	}
+
+	if f.Cipher == nil {
+		buf = append(buf, value...)
+		return append(buf, checksum...), nil
+	}
+
+	// The checksum is sealed with the value so that it is validated against the decrypted value
+	// when it is read.
+	plaintext := make([]byte, 0, len(value)+len(checksum))
+	plaintext = append(append(plaintext, value...), checksum...)
+	buf, err := sealBlock(f.Cipher, buf, plaintext, f.additionalData(header, offset))
+	if err != nil {
+		return nil, fmt.Errorf(
+			"encrypting value at offset %d of value file %d: %w", offset, f.FileId, err,
+		)
+	}
+
+	return buf, nil
 }
 
 // Sync will flush the changes made to the value file to the disk if the file interface implements
 // the CanSync interface. If it does not then nothing happens and nil is returned.
 func (f *valueFile) Sync() error {
 	if canSync, ok := f.File.(CanSync); ok {
-		return canSync.Sync()
+		if err := canSync.Sync(); err != nil {
+			return newFileError(ErrWritingFile, err, "syncing value file %d", f.FileId)
+		}
 	}
 
 	return nil
 }
+
+// Close will close the value file if the file interface implements the io.Closer interface. The
+// file will only ever be closed once, subsequent calls will return the result of the first call.
+func (f *valueFile) Close() error {
+	f.closeOnce.Do(func() {
+		if closer, ok := f.File.(io.Closer); ok {
+			f.closeErr = closer.Close()
+		}
+	})
+
+	return f.closeErr
+}
@@ -1,25 +1,38 @@
 package lsmtree
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"path"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestOpenValueFile(t *testing.T) {
 	t.Run("directory doesnt exist", func(t *testing.T) {
-		file, err := openValueFile("tmp", 1)
+		file, err := openValueFile("tmp", 1, true)
 		assert.Error(t, err)
 		assert.Nil(t, file)
+		assert.True(t, errors.Is(err, ErrOpeningFile))
+		assert.True(t, errors.Is(err, os.ErrNotExist))
 	})
 
 	t.Run("create file", func(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openValueFile(dir, 1)
+		file, err := openValueFile(dir, 1, true)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 	})
@@ -30,7 +43,7 @@ func TestValueFile_Write(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openValueFile(dir, 1)
+		file, err := openValueFile(dir, 1, true)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -43,8 +56,8 @@ func TestValueFile_Write(t *testing.T) {
 		offset2, err := file.Write(originalValue2)
 		assert.NoError(t, err)
 		// Make sure the offset of the second value is the length of the first value appended plus the
-		// size of the checksum for the first value.
-		assert.Equal(t, uint64(len(originalValue1)+4), offset2)
+		// size of the length header and checksum for the first value.
+		assert.Equal(t, uint64(4+len(originalValue1)+4), offset2)
 	})
 
 	t.Run("asynchronous", func(t *testing.T) {
@@ -79,14 +92,14 @@ func TestValueFile_Write(t *testing.T) {
 			wg.Wait()
 
 			// Make sure the new offset matches the expected.
-			assert.Equal(t, uint64(numberOfValues*(8+4)), file.Offset)
+			assert.Equal(t, uint64(numberOfValues*(4+8+4)), file.Offset)
 		}
 
 		t.Run("os.File", func(t *testing.T) {
 			dir, cleanup := NewTempDirectory(t)
 			defer cleanup()
 
-			file, err := openValueFile(dir, 1)
+			file, err := openValueFile(dir, 1, true)
 			assert.NoError(t, err)
 			assert.NotNil(t, file)
 
@@ -95,12 +108,72 @@ func TestValueFile_Write(t *testing.T) {
 	})
 }
 
+func TestValueFile_WriteBatch(t *testing.T) {
+	t.Run("values read back", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		first, err := file.Write([]byte("before the batch"))
+		assert.NoError(t, err)
+
+		values := [][]byte{
+			[]byte("value one"),
+			{},
+			[]byte("a third and much longer value than the others"),
+			[]byte("4"),
+		}
+		offsets, err := file.WriteBatch(values)
+		assert.NoError(t, err)
+		assert.Len(t, offsets, len(values))
+
+		// The values should be stored next to each other after the value before the batch.
+		next := first + file.entrySize(uint64(len("before the batch")))
+		for i, value := range values {
+			assert.Equal(t, next, offsets[i])
+			next += file.entrySize(uint64(len(value)))
+
+			read, err := file.Read(offsets[i], uint64(len(value)))
+			assert.NoError(t, err)
+			assert.Equal(t, value, read)
+		}
+		assert.Equal(t, next, file.Offset)
+	})
+
+	t.Run("single write", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		faulty := newFaultyFile(file.File)
+		file.File = faulty
+		file.Cipher = newTestCipher(t, "secret")
+
+		values := [][]byte{[]byte("value one"), []byte("value two"), []byte("value three")}
+		offsets, err := file.WriteBatch(values)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, faulty.Writes)
+
+		for i, value := range values {
+			read, err := file.Read(offsets[i], uint64(len(value)))
+			assert.NoError(t, err)
+			assert.Equal(t, value, read)
+		}
+	})
+}
+
 func TestValueFile_Read(t *testing.T) {
 	t.Run("synchronous", func(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openValueFile(dir, 1)
+		file, err := openValueFile(dir, 1, true)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -113,8 +186,8 @@ func TestValueFile_Read(t *testing.T) {
 		offset2, err := file.Write(originalValue2)
 		assert.NoError(t, err)
 		// Make sure the offset of the second value is the length of the first value appended plus the
-		// size of the checksum for the first value.
-		assert.Equal(t, uint64(len(originalValue1)+4), offset2)
+		// size of the length header and checksum for the first value.
+		assert.Equal(t, uint64(4+len(originalValue1)+4), offset2)
 
 		readValue1, err := file.Read(offset1, uint64(len(originalValue1)))
 		assert.NoError(t, err)
@@ -172,7 +245,7 @@ func TestValueFile_Read(t *testing.T) {
 			wg.Wait()
 
 			// Make sure the new offset matches the expected.
-			assert.Equal(t, uint64(numberOfValues*(8+4)), file.Offset)
+			assert.Equal(t, uint64(numberOfValues*(4+8+4)), file.Offset)
 
 			wg = sync.WaitGroup{}
 			wg.Add(numberOfRoutines)
@@ -196,7 +269,7 @@ func TestValueFile_Read(t *testing.T) {
 			dir, cleanup := NewTempDirectory(t)
 			defer cleanup()
 
-			file, err := openValueFile(dir, 1)
+			file, err := openValueFile(dir, 1, true)
 			assert.NoError(t, err)
 			assert.NotNil(t, file)
 
@@ -205,81 +278,1293 @@ func TestValueFile_Read(t *testing.T) {
 	})
 }
 
-func BenchmarkValueFile_Write(b *testing.B) {
-	dir, cleanup := NewTempDirectory(b)
+func TestValueFile_ZeroLength(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
 	defer cleanup()
 
-	file, err := openValueFile(dir, 1)
-	assert.NoError(b, err)
-	assert.NotNil(b, file)
+	file, err := openValueFile(dir, 1, true)
+	assert.NoError(t, err)
+	assert.NotNil(t, file)
 
-	value := []byte("test benchmark value for write")
+	for _, value := range [][]byte{nil, {}} {
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
 
-	b.ReportAllocs()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, _ = file.Write(value)
+		read, err := file.Read(offset, 0)
+		assert.NoError(t, err)
+		assert.NotNil(t, read)
+		assert.Empty(t, read)
 	}
+
+	// Each empty value still takes up room for its header and checksum.
+	assert.Equal(t, uint64(2*(valueHeaderSize+valueChecksumSize)), file.Offset)
+
+	// Reading an empty value with a size is a mismatch, not a short value.
+	_, err = file.Write([]byte("value"))
+	assert.NoError(t, err)
+	_, err = file.Read(0, 1)
+	assert.True(t, errors.Is(err, ErrValueSizeMismatch))
 }
 
-func BenchmarkValueFile_Read(b *testing.B) {
-	dir, cleanup := NewTempDirectory(b)
-	defer cleanup()
+func TestValueFile_Borrow(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted %t", encrypted), func(t *testing.T) {
+			dir, cleanup := NewTempDirectory(t)
+			defer cleanup()
 
-	file, err := openValueFile(dir, 1)
-	assert.NoError(b, err)
-	assert.NotNil(b, file)
+			file, err := openValueFile(dir, 1, true)
+			assert.NoError(t, err)
+			assert.NotNil(t, file)
+			if encrypted {
+				file.Cipher = newTestCipher(t, "secret")
+			}
 
-	numberOfValues := 1000
-	numberOfRoutines := 8
+			values := [][]byte{[]byte("value one"), {}, bytes.Repeat([]byte("a"), 8192)}
+			offsets, err := file.WriteBatch(values)
+			assert.NoError(t, err)
 
-	// Make sure that the number of values divides evenly into the
-	// number of routines.
-	assert.Equal(b, 0, numberOfValues%numberOfRoutines)
+			for i, value := range values {
+				handle, err := file.Borrow(offsets[i], uint64(len(value)))
+				assert.NoError(t, err)
+				assert.NotNil(t, handle.Bytes())
+				assert.Equal(t, value, handle.Bytes())
+				handle.Release()
+			}
+		})
+	}
 
-	values := make([][]byte, numberOfValues)
-	for i := 0; i < numberOfValues; i++ {
-		v := make([]byte, 8)
-		binary.BigEndian.PutUint64(v, rand.Uint64())
-		values[i] = v
+	t.Run("bad checksum", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+
+		_, err = file.File.WriteAt([]byte("V"), int64(offset+valueHeaderSize))
+		assert.NoError(t, err)
+
+		handle, err := file.Borrow(offset, uint64(len(value)))
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+		assert.Nil(t, handle.Bytes())
+		handle.Release()
+
+		// The corrupt value is still returned when checksum errors are ignored, and must still be
+		// released.
+		file.IgnoreChecksumErrors = true
+		handle, err = file.Borrow(offset, uint64(len(value)))
+		assert.True(t, errors.Is(err, ErrValueChecksumIgnored))
+		assert.Equal(t, []byte("Value one"), handle.Bytes())
+		handle.Release()
+	})
+}
+
+func TestValueFile_DisableChecksums(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted %t", encrypted), func(t *testing.T) {
+			dir, cleanup := NewTempDirectory(t)
+			defer cleanup()
+
+			file, err := openValueFile(dir, 1, true)
+			assert.NoError(t, err)
+			assert.NotNil(t, file)
+			file.DisableChecksums = true
+			if encrypted {
+				file.Cipher = newTestCipher(t, "secret")
+			}
+
+			values := [][]byte{[]byte("value one"), {}, []byte("another value")}
+			offsets, err := file.WriteBatch(values)
+			assert.NoError(t, err)
+
+			// No room should be used for the checksums.
+			size := uint64(0)
+			for i, value := range values {
+				assert.Equal(t, size, offsets[i])
+				size += uint64(valueHeaderSize + len(value) + cipherOverhead(file.Cipher))
+
+				read, err := file.Read(offsets[i], uint64(len(value)))
+				assert.NoError(t, err)
+				assert.Equal(t, value, read)
+			}
+			assert.Equal(t, size, file.Offset)
+
+			i := 0
+			err = file.Iterate(func(offset, size uint64, value []byte) error {
+				assert.Equal(t, offsets[i], offset)
+				assert.Equal(t, values[i], value)
+				i++
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, len(values), i)
+		})
 	}
 
-	type Read struct {
-		ExpectedValue []byte
-		Offset        uint64
-		Size          uint64
+	t.Run("corruption is not detected", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+		file.DisableChecksums = true
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+
+		_, err = file.File.WriteAt([]byte("V"), int64(offset+valueHeaderSize))
+		assert.NoError(t, err)
+
+		read, err := file.Read(offset, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("Value one"), read)
+	})
+}
+
+func TestValueFile_Recover(t *testing.T) {
+	values := [][]byte{[]byte("value one"), {}, []byte("another value")}
+
+	// Each tail is what might be left at the end of the file by a write that was interrupted.
+	tails := map[string]func(file *valueFile) []byte{
+		"partial header": func(file *valueFile) []byte {
+			return []byte{0, 0}
+		},
+		"partial value": func(file *valueFile) []byte {
+			return []byte{0, 0, 0, 100, 'v', 'a', 'l'}
+		},
+		"bad checksum": func(file *valueFile) []byte {
+			entry, err := file.appendEntry(nil, []byte("torn"), file.Offset)
+			assert.NoError(t, err)
+			entry[len(entry)-1]++
+			return entry
+		},
+		"zeroes": func(file *valueFile) []byte {
+			return make([]byte, 64)
+		},
 	}
 
-	forRead := make(chan Read, numberOfValues)
+	for _, encrypted := range []bool{false, true} {
+		for name, tail := range tails {
+			t.Run(fmt.Sprintf("%s encrypted %t", name, encrypted), func(t *testing.T) {
+				dir, cleanup := NewTempDirectory(t)
+				defer cleanup()
 
-	wg := sync.WaitGroup{}
-	wg.Add(numberOfRoutines)
-	numberOfValuesPerRoutine := len(values) / numberOfRoutines
+				var c cipher.AEAD
+				if encrypted {
+					c = newTestCipher(t, "secret")
+				}
 
-	// Make sure that we can write to the valueFile concurrently.
-	for i := 0; i < numberOfRoutines; i++ {
-		go func(i int) {
-			defer wg.Done()
-			routineValues := values[i*numberOfValuesPerRoutine : i*numberOfValuesPerRoutine+numberOfValuesPerRoutine]
-			for _, value := range routineValues {
-				offset, err := file.Write(value)
-				assert.NoError(b, err)
-				forRead <- Read{
-					ExpectedValue: value,
-					Offset:        offset,
-					Size:          uint64(len(value)),
+				file, err := openValueFile(dir, 1, true)
+				assert.NoError(t, err)
+				file.Cipher = c
+
+				offsets, err := file.WriteBatch(values)
+				assert.NoError(t, err)
+				end := file.Offset
+
+				_, err = file.File.WriteAt(tail(file), int64(end))
+				assert.NoError(t, err)
+				assert.NoError(t, file.Close())
+
+				file, err = openValueFile(dir, 1, true)
+				assert.NoError(t, err)
+				defer file.Close()
+				file.Cipher = c
+				size := file.Offset
+				assert.Greater(t, size, end)
+
+				removed, err := file.Recover()
+				assert.NoError(t, err)
+				assert.Equal(t, size-end, removed)
+				assert.Equal(t, end, file.Offset)
+
+				stat, err := file.File.(*os.File).Stat()
+				assert.NoError(t, err)
+				assert.Equal(t, int64(end), stat.Size())
+
+				// The next value should be written where the partial value was.
+				offset, err := file.Write([]byte("next value"))
+				assert.NoError(t, err)
+				assert.Equal(t, end, offset)
+
+				expected := append(values[:len(values):len(values)], []byte("next value"))
+				offsets = append(offsets, offset)
+				for i, value := range expected {
+					read, err := file.Read(offsets[i], uint64(len(value)))
+					assert.NoError(t, err)
+					assert.Equal(t, value, read)
 				}
-			}
-		}(i)
+
+				// Nothing should be removed from a file that is intact.
+				removed, err = file.Recover()
+				assert.NoError(t, err)
+				assert.Zero(t, removed)
+			})
+		}
 	}
-	wg.Wait()
 
-	// Make sure the new offset matches the expected.
-	assert.Equal(b, uint64(numberOfValues*(8+4)), file.Offset)
+	t.Run("value manager", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
 
-	b.ReportAllocs()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, _ = file.Read(0, 8)
-	}
+		manager, err := newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+
+		fileId, offset, size, err := manager.Write(nil, []byte("value one"))
+		assert.NoError(t, err)
+		file, err := manager.acquire(fileId)
+		assert.NoError(t, err)
+		end := file.Offset
+		_, err = file.File.WriteAt([]byte{0, 0, 0, 100}, int64(end))
+		assert.NoError(t, err)
+		manager.release(file)
+		assert.NoError(t, manager.Close())
+
+		// The partial value should be removed once the manager is reopened.
+		manager, err = newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		defer manager.Close()
+
+		nextFileId, nextOffset, _, err := manager.Write(nil, []byte("value two"))
+		assert.NoError(t, err)
+		assert.Equal(t, fileId, nextFileId)
+		assert.Equal(t, end, nextOffset)
+
+		value, err := manager.Read(nil, fileId, offset, size)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value one"), value)
+	})
+}
+
+func TestValueFile_Errors(t *testing.T) {
+	t.Run("bad checksum", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+
+		// Corrupt the first byte of the value.
+		_, err = file.File.WriteAt([]byte("V"), int64(offset+valueHeaderSize))
+		assert.NoError(t, err)
+
+		_, err = file.Read(offset, uint64(len(value)))
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+	})
+
+	t.Run("bad checksum on zero-length value", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		offset, err := file.Write([]byte{})
+		assert.NoError(t, err)
+
+		// There is no value to corrupt, so corrupt the checksum itself.
+		_, err = file.File.WriteAt([]byte{0}, int64(offset+valueHeaderSize))
+		assert.NoError(t, err)
+
+		_, err = file.Read(offset, 0)
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+	})
+
+	t.Run("closed file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+		assert.NoError(t, file.Close())
+
+		_, err = file.Write([]byte("value one"))
+		assert.True(t, errors.Is(err, ErrWritingFile))
+		assert.True(t, errors.Is(err, os.ErrClosed))
+
+		_, err = file.Read(0, 1)
+		assert.True(t, errors.Is(err, ErrReadingFile))
+		assert.True(t, errors.Is(err, os.ErrClosed))
+		assert.False(t, errors.Is(err, ErrWritingFile))
+
+		var pathError *os.PathError
+		assert.True(t, errors.As(err, &pathError))
+	})
+}
+
+func TestValueFile_Retry(t *testing.T) {
+	t.Run("transient errors", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		faulty := newFaultyFile(file.File)
+		faulty.FailWrites(syscall.EAGAIN, syscall.EINTR)
+		file.File = faulty
+		file.Retry = RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Microsecond,
+		}
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), offset)
+
+		// The write should have only landed once and the offset should only have been advanced
+		// once.
+		assert.Equal(t, 1, faulty.Writes)
+		assert.Equal(t, uint64(valueHeaderSize+len(value)+valueChecksumSize), file.Offset)
+
+		read, err := file.Read(offset, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, read)
+	})
+
+	t.Run("too many transient errors", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		faulty := newFaultyFile(file.File)
+		faulty.FailWrites(syscall.EAGAIN, syscall.EAGAIN)
+		file.File = faulty
+		file.Retry = RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     time.Microsecond,
+		}
+
+		_, err = file.Write([]byte("value one"))
+		assert.True(t, errors.Is(err, ErrWritingFile))
+		assert.True(t, errors.Is(err, syscall.EAGAIN))
+		assert.Equal(t, 0, faulty.Writes)
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		faulty := newFaultyFile(file.File)
+		faulty.FailWrites(syscall.EIO)
+		file.File = faulty
+		file.Retry = RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Microsecond,
+		}
+
+		// The permanent error should be returned immediately without using up the retries.
+		_, err = file.Write([]byte("value one"))
+		assert.True(t, errors.Is(err, syscall.EIO))
+
+		_, err = file.Write([]byte("value one"))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, faulty.Writes)
+	})
+
+	t.Run("disk full", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		faulty := newFaultyFile(file.File)
+		faulty.FailWrites(syscall.ENOSPC)
+		file.File = faulty
+		file.Retry = RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Microsecond,
+		}
+
+		_, err = file.Write([]byte("value one"))
+		assert.True(t, errors.Is(err, ErrDiskFull))
+		assert.True(t, errors.Is(err, ErrWritingFile))
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		assert.Equal(t, uint64(0), file.Offset)
+
+		// Once there is space again the value should be written where the failed one would have
+		// been.
+		value := []byte("value two")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), offset)
+
+		read, err := file.Read(offset, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, read)
+	})
+}
+
+func TestValueFile_Iterate(t *testing.T) {
+	t.Run("several values", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		values := [][]byte{
+			[]byte("value one"),
+			[]byte("another value"),
+			[]byte("a third and much longer value than the others"),
+			[]byte("4"),
+		}
+
+		offsets := make([]uint64, len(values))
+		for i, value := range values {
+			offsets[i], err = file.Write(value)
+			assert.NoError(t, err)
+		}
+
+		i := 0
+		err = file.Iterate(func(offset, size uint64, value []byte) error {
+			assert.Equal(t, offsets[i], offset)
+			assert.Equal(t, uint64(len(values[i])), size)
+			assert.Equal(t, values[i], value)
+			i++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, len(values), i)
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		err = file.Iterate(func(offset, size uint64, value []byte) error {
+			t.Fatal("should not be called for an empty file")
+			return nil
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("size mismatch", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+
+		_, err = file.Read(offset, uint64(len(value)-1))
+		assert.True(t, errors.Is(err, ErrValueSizeMismatch))
+	})
+}
+
+func TestNewValueManager(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir+"/data", 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+
+		err = manager.Close()
+		assert.NoError(t, err)
+	})
+}
+
+func TestValueManager_Read(t *testing.T) {
+	t.Run("evicted file is reopened", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+		defer manager.Close()
+
+		file, err := manager.acquire(1)
+		assert.NoError(t, err)
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+		manager.release(file)
+
+		manager.evict(1)
+		assert.NotContains(t, manager.files, uint64(1))
+
+		// The handle that was evicted should have been closed.
+		_, err = file.Read(offset, uint64(len(value)))
+		assert.Error(t, err)
+
+		read, err := manager.Read(nil, 1, offset, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, read)
+		assert.Contains(t, manager.files, uint64(1))
+		assert.NotEqual(t, file, manager.files[1])
+	})
+
+	t.Run("evicted while referenced", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+		defer manager.Close()
+
+		file, err := manager.acquire(1)
+		assert.NoError(t, err)
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+
+		// The file should not be closed while we are still holding a reference to it.
+		manager.evict(1)
+		read, err := file.Read(offset, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, read)
+
+		manager.release(file)
+		_, err = file.Read(offset, uint64(len(value)))
+		assert.Error(t, err)
+	})
+
+	t.Run("concurrent reopen", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+		defer manager.Close()
+
+		file, err := manager.acquire(1)
+		assert.NoError(t, err)
+
+		value := []byte("value one")
+		offset, err := file.Write(value)
+		assert.NoError(t, err)
+		manager.release(file)
+
+		numberOfRoutines := 8
+		numberOfReads := 100
+		wg := sync.WaitGroup{}
+		wg.Add(numberOfRoutines)
+		for i := 0; i < numberOfRoutines; i++ {
+			go func(i int) {
+				defer wg.Done()
+				for x := 0; x < numberOfReads; x++ {
+					// Have one of the routines constantly evict the file so that the others
+					// need to reopen it.
+					if i == 0 {
+						manager.evict(1)
+						continue
+					}
+
+					read, err := manager.Read(nil, 1, offset, uint64(len(value)))
+					assert.NoError(t, err)
+					assert.Equal(t, value, read)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("file does not exist", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		manager.shardDepth = 1
+		defer manager.Close()
+
+		_, err = manager.Read(nil, 0x1234, 0, 8)
+		assert.True(t, errors.Is(err, ErrOpeningFile))
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+
+		// Reading the file should not have created it, or its shard directory.
+		entries, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+		assert.NotContains(t, manager.files, uint64(0x1234))
+	})
+}
+
+func TestValueManager_Write(t *testing.T) {
+	t.Run("rolls over to new file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+		defer manager.Close()
+
+		value := []byte("a value that is 24 bytes")
+		fileId1, offset1, _, err := manager.Write(nil, value)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), fileId1)
+
+		// The first write put the file over the limit, so this should be in a new file.
+		fileId2, offset2, _, err := manager.Write(nil, value)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), fileId2)
+
+		read, err := manager.Read(nil, fileId1, offset1, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, read)
+
+		read, err = manager.Read(nil, fileId2, offset2, uint64(len(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, read)
+	})
+
+	t.Run("resumes at the last file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager(dir, 32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+
+		value := []byte("a value that is 24 bytes")
+		for i := 0; i < 3; i++ {
+			_, _, _, err = manager.Write(nil, value)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, manager.Close())
+
+		manager, err = newValueManager(dir, 32, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		defer manager.Close()
+		assert.Equal(t, uint64(3), manager.currentFileId)
+	})
+}
+
+func TestValueLocator(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		locators := []ValueLocator{
+			{},
+			{FileId: 1, Offset: 0, Size: 9},
+			{FileId: 0x1234, Offset: 1 << 20, Size: 1 << 32},
+			{FileId: math.MaxUint64, Offset: math.MaxUint64, Size: math.MaxUint64},
+		}
+
+		for _, locator := range locators {
+			data := locator.Encode()
+
+			var decoded ValueLocator
+			assert.NoError(t, decoded.Decode(data))
+			assert.Equal(t, locator, decoded)
+		}
+
+		// Small locators should only take a byte for each field.
+		assert.Len(t, ValueLocator{FileId: 1, Offset: 100, Size: 9}.Encode(), 3)
+	})
+
+	t.Run("bad locator", func(t *testing.T) {
+		data := ValueLocator{FileId: 1, Offset: 1 << 20, Size: 9}.Encode()
+		for _, bad := range [][]byte{nil, data[:1], data[:len(data)-1], append(data, 0)} {
+			locator := ValueLocator{FileId: 5}
+			assert.Equal(t, ErrBadValueLocator, locator.Decode(bad))
+			assert.Equal(t, ValueLocator{FileId: 5}, locator)
+		}
+	})
+}
+
+func TestValueManager_ReadLocator(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	manager, err := newValueManager(dir, 16, 0, RetryPolicy{}, true)
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	values := [][]byte{[]byte("value one"), []byte("value two"), {}}
+	locators := make([][]byte, len(values))
+	for i, value := range values {
+		fileId, offset, size, err := manager.Write(nil, value)
+		assert.NoError(t, err)
+		locators[i] = ValueLocator{FileId: fileId, Offset: offset, Size: size}.Encode()
+	}
+
+	// The values should be read back from just their encoded locators, across value files.
+	for i, data := range locators {
+		var locator ValueLocator
+		assert.NoError(t, locator.Decode(data))
+
+		value, err := manager.ReadLocator(nil, locator)
+		assert.NoError(t, err)
+		assert.Equal(t, values[i], value)
+	}
+}
+
+func TestValueManager_MaxOpenFiles(t *testing.T) {
+	t.Run("handles stay bounded", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		maxOpenFiles := 3
+		manager, err := newValueManager(dir, 1, maxOpenFiles, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+		defer manager.Close()
+
+		type Locator struct {
+			FileId uint64
+			Offset uint64
+		}
+
+		// Every write will create a new value file because the chunk size is 1 byte.
+		value := []byte("value")
+		locators := make([]Locator, 0)
+		for i := 0; i < 20; i++ {
+			fileId, offset, _, err := manager.Write(nil, value)
+			assert.NoError(t, err)
+			locators = append(locators, Locator{
+				FileId: fileId,
+				Offset: offset,
+			})
+			assert.True(t, atomic.LoadInt64(&manager.openFiles) <= int64(maxOpenFiles))
+		}
+
+		for _, locator := range locators {
+			read, err := manager.Read(nil, locator.FileId, locator.Offset, uint64(len(value)))
+			assert.NoError(t, err)
+			assert.Equal(t, value, read)
+			assert.True(t, atomic.LoadInt64(&manager.openFiles) <= int64(maxOpenFiles))
+			assert.True(t, len(manager.files) <= maxOpenFiles)
+		}
+	})
+
+	t.Run("current file is never evicted", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		value := []byte("value")
+		offsets := make([]uint64, 4)
+		for i := range offsets {
+			file, err := openValueFile(dir, uint64(i+1), true)
+			assert.NoError(t, err)
+			offsets[i], err = file.Write(value)
+			assert.NoError(t, err)
+			assert.NoError(t, file.Close())
+		}
+
+		manager, err := newValueManager(dir, 1024*32, 1, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+		defer manager.Close()
+
+		fileId, _, _, err := manager.Write(nil, value)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), fileId)
+
+		for i := 0; i < 3; i++ {
+			read, err := manager.Read(nil, uint64(i+1), offsets[i], uint64(len(value)))
+			assert.NoError(t, err)
+			assert.Equal(t, value, read)
+			assert.Contains(t, manager.files, uint64(4))
+			assert.Len(t, manager.files, 1)
+		}
+	})
+}
+
+func BenchmarkValueFile_Write(b *testing.B) {
+	dir, cleanup := NewTempDirectory(b)
+	defer cleanup()
+
+	file, err := openValueFile(dir, 1, true)
+	assert.NoError(b, err)
+	assert.NotNil(b, file)
+
+	value := []byte("test benchmark value for write")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = file.Write(value)
+	}
+}
+
+func BenchmarkValueFile_DisableChecksums(b *testing.B) {
+	value := make([]byte, 4096)
+	rand.Read(value)
+	for _, disabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("disabled %t", disabled), func(b *testing.B) {
+			dir, cleanup := NewTempDirectory(b)
+			defer cleanup()
+
+			file, err := openValueFile(dir, 1, true)
+			assert.NoError(b, err)
+			file.DisableChecksums = disabled
+
+			b.SetBytes(int64(len(value)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = file.Write(value)
+			}
+		})
+	}
+}
+
+func BenchmarkValueFile_WriteBatch(b *testing.B) {
+	value := []byte("test benchmark value for write")
+	for _, batchSize := range []int{1, 16, 128} {
+		batch := make([][]byte, batchSize)
+		for i := range batch {
+			batch[i] = value
+		}
+
+		b.Run(fmt.Sprintf("loop %d", batchSize), func(b *testing.B) {
+			dir, cleanup := NewTempDirectory(b)
+			defer cleanup()
+
+			file, err := openValueFile(dir, 1, true)
+			assert.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, value := range batch {
+					_, _ = file.Write(value)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("batch %d", batchSize), func(b *testing.B) {
+			dir, cleanup := NewTempDirectory(b)
+			defer cleanup()
+
+			file, err := openValueFile(dir, 1, true)
+			assert.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = file.WriteBatch(batch)
+			}
+		})
+	}
+}
+
+func BenchmarkValueFile_Read(b *testing.B) {
+	dir, cleanup := NewTempDirectory(b)
+	defer cleanup()
+
+	file, err := openValueFile(dir, 1, true)
+	assert.NoError(b, err)
+	assert.NotNil(b, file)
+
+	numberOfValues := 1000
+	numberOfRoutines := 8
+
+	// Make sure that the number of values divides evenly into the
+	// number of routines.
+	assert.Equal(b, 0, numberOfValues%numberOfRoutines)
+
+	values := make([][]byte, numberOfValues)
+	for i := 0; i < numberOfValues; i++ {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, rand.Uint64())
+		values[i] = v
+	}
+
+	type Read struct {
+		ExpectedValue []byte
+		Offset        uint64
+		Size          uint64
+	}
+
+	forRead := make(chan Read, numberOfValues)
+
+	wg := sync.WaitGroup{}
+	wg.Add(numberOfRoutines)
+	numberOfValuesPerRoutine := len(values) / numberOfRoutines
+
+	// Make sure that we can write to the valueFile concurrently.
+	for i := 0; i < numberOfRoutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			routineValues := values[i*numberOfValuesPerRoutine : i*numberOfValuesPerRoutine+numberOfValuesPerRoutine]
+			for _, value := range routineValues {
+				offset, err := file.Write(value)
+				assert.NoError(b, err)
+				forRead <- Read{
+					ExpectedValue: value,
+					Offset:        offset,
+					Size:          uint64(len(value)),
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Make sure the new offset matches the expected.
+	assert.Equal(b, uint64(numberOfValues*(4+8+4)), file.Offset)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = file.Read(0, 8)
+	}
+}
+
+func BenchmarkValueFile_Borrow(b *testing.B) {
+	dir, cleanup := NewTempDirectory(b)
+	defer cleanup()
+
+	file, err := openValueFile(dir, 1, true)
+	assert.NoError(b, err)
+
+	value := make([]byte, 4096)
+	rand.Read(value)
+	offset, err := file.Write(value)
+	assert.NoError(b, err)
+
+	b.Run("read", func(b *testing.B) {
+		b.SetBytes(int64(len(value)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = file.Read(offset, uint64(len(value)))
+		}
+	})
+
+	b.Run("borrow", func(b *testing.B) {
+		b.SetBytes(int64(len(value)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			handle, _ := file.Borrow(offset, uint64(len(value)))
+			handle.Release()
+		}
+	})
+}
+
+func TestValueFile_IgnoreChecksumErrors(t *testing.T) {
+	values := [][]byte{
+		[]byte("value one"),
+		[]byte("value two"),
+		[]byte("value three"),
+	}
+
+	// newCorruptFile writes the values to a new file and then corrupts the second one.
+	newCorruptFile := func(t *testing.T, dir string) (*valueFile, []uint64) {
+		file, err := openValueFile(dir, 1, true)
+		assert.NoError(t, err)
+
+		offsets := make([]uint64, len(values))
+		for i, value := range values {
+			offsets[i], err = file.Write(value)
+			assert.NoError(t, err)
+		}
+
+		_, err = file.File.WriteAt([]byte("X"), int64(offsets[1]+valueHeaderSize))
+		assert.NoError(t, err)
+
+		return file, offsets
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, offsets := newCorruptFile(t, dir)
+		defer file.Close()
+
+		value, err := file.Read(offsets[1], uint64(len(values[1])))
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+		assert.Nil(t, value)
+
+		err = file.Iterate(func(offset, size uint64, value []byte) error {
+			return nil
+		})
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+	})
+
+	t.Run("salvage", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, offsets := newCorruptFile(t, dir)
+		defer file.Close()
+		file.IgnoreChecksumErrors = true
+
+		// The corrupt value is still returned, but with a warning.
+		value, err := file.Read(offsets[1], uint64(len(values[1])))
+		assert.True(t, errors.Is(err, ErrValueChecksumIgnored))
+		assert.Equal(t, []byte("Xalue two"), value)
+
+		value, err = file.Read(offsets[0], uint64(len(values[0])))
+		assert.NoError(t, err)
+		assert.Equal(t, values[0], value)
+
+		// Iterating should skip the corrupt value and return the rest.
+		salvaged := make([][]byte, 0)
+		err = file.Iterate(func(offset, size uint64, value []byte) error {
+			salvaged = append(salvaged, append([]byte{}, value...))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{values[0], values[2]}, salvaged)
+	})
+}
+
+func TestWalTransactionChange_ValueLocation(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("values written before a crash encrypted %t", encrypted), func(t *testing.T) {
+			dir, cleanup := NewTempDirectory(t)
+			defer cleanup()
+
+			// The codec and the cipher both change the number of bytes that are stored for a
+			// value, so the value can only be read back with the size recorded in the WAL.
+			openManagers := func() (*walManager, *valueManager) {
+				wal, err := newWalManager(path.Join(dir, "wal"), 1024*32, 0, RetryPolicy{}, true)
+				assert.NoError(t, err)
+				values, err := newValueManager(
+					path.Join(dir, "data"), 1024*32, 0, RetryPolicy{}, true,
+				)
+				assert.NoError(t, err)
+				values.codec = lengthCodec{}
+				if encrypted {
+					wal.Cipher = newTestCipher(t, "secret")
+					values.cipher = newTestCipher(t, "secret")
+				}
+				return wal, values
+			}
+			wal, values := openManagers()
+
+			// The values for the first transaction are written to the value files before the
+			// transaction is appended, the second transaction's values are not.
+			stored := walTransaction{
+				TransactionId: 1,
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key one"),
+						Value: []byte("value one"),
+					},
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key two"),
+						Value: []byte{},
+					},
+					{
+						Type: walTransactionChangeTypeDelete,
+						Key:  []byte("key three"),
+					},
+				},
+			}
+			for i := range stored.Entries[:2] {
+				change := &stored.Entries[i]
+				fileId, offset, size, err := values.Write(change.Key, change.Value)
+				assert.NoError(t, err)
+				assert.NotEqual(t, uint64(len(change.Value)), size)
+				change.ValueLocation = ValueLocator{FileId: fileId, Offset: offset, Size: size}
+			}
+			assert.NoError(t, wal.Append(stored))
+			assert.NoError(t, wal.Append(walTransaction{
+				TransactionId: 2,
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key four"),
+						Value: []byte("value four"),
+					},
+				},
+			}))
+
+			// Crash before the keys are ever flushed to a heap file.
+			assert.NoError(t, values.Sync())
+			assert.NoError(t, wal.Close())
+			assert.NoError(t, values.Close())
+
+			wal, values = openManagers()
+			defer wal.Close()
+			defer values.Close()
+
+			itr, err := wal.ReadFrom(0)
+			assert.NoError(t, err)
+
+			transactions := make([]walTransaction, 0)
+			for ; itr.Valid(); itr.Next() {
+				transactions = append(transactions, itr.Transaction())
+			}
+			assert.NoError(t, itr.Err())
+			assert.Len(t, transactions, 2)
+			assert.Equal(t, stored.Entries, transactions[0].Entries)
+
+			// The values that were already stored can be read back from where the WAL says they
+			// are, and the value that was never stored does not have a location.
+			for _, change := range transactions[0].Entries[:2] {
+				value, err := values.ReadLocator(change.Key, change.ValueLocation)
+				assert.NoError(t, err)
+				assert.Equal(t, change.Value, value)
+			}
+			assert.Equal(t, ValueLocator{}, transactions[1].Entries[0].ValueLocation)
+		})
+	}
+
+	t.Run("location is optional", func(t *testing.T) {
+		// A location must never be read out of a change that does not have one, no matter what
+		// comes after the value.
+		changes := []walTransactionChange{
+			{
+				Type:  walTransactionChangeTypeSet,
+				Key:   []byte("key"),
+				Value: []byte{},
+			},
+			{
+				Type:          walTransactionChangeTypeSet,
+				Key:           []byte("key"),
+				Value:         bytes.Repeat([]byte{1}, 16),
+				ValueLocation: ValueLocator{FileId: 1, Offset: 1 << 40, Size: 20},
+			},
+			{
+				Type: walTransactionChangeTypeDelete,
+				Key:  []byte("key"),
+			},
+		}
+
+		for _, change := range changes {
+			decoded := walTransactionChange{}
+			decoded.Decode(change.Encode())
+			assert.Equal(t, change, decoded)
+		}
+	})
+}
+
+// lengthCodec is a ValueCodec that stores every value prefixed with its length as a uvarint, so
+// that the number of bytes stored for a value is never the length of the value.
+type lengthCodec struct{}
+
+func (lengthCodec) Name() string {
+	return "length"
+}
+
+func (lengthCodec) Encode(key, value []byte) []byte {
+	stored := make([]byte, binary.MaxVarintLen64+len(value))
+	n := binary.PutUvarint(stored, uint64(len(value)))
+	return append(stored[:n], value...)
+}
+
+func (lengthCodec) Decode(key, stored []byte) []byte {
+	size, n := binary.Uvarint(stored)
+	return stored[n : n+int(size)]
+}
+
+// namedCodec is a lengthCodec with whatever name it is given.
+type namedCodec struct {
+	lengthCodec
+	name string
+}
+
+func (c namedCodec) Name() string {
+	return c.name
+}
+
+// upperCodec is a ValueCodec that stores the values of keys prefixed with "upper/" in upper case.
+type upperCodec struct {
+	encoded, decoded int
+}
+
+func (c *upperCodec) Name() string {
+	return "upper"
+}
+
+func (c *upperCodec) Encode(key, value []byte) []byte {
+	if !bytes.HasPrefix(key, []byte("upper/")) {
+		return value
+	}
+
+	c.encoded++
+	return bytes.ToUpper(value)
+}
+
+func (c *upperCodec) Decode(key, stored []byte) []byte {
+	if !bytes.HasPrefix(key, []byte("upper/")) {
+		return stored
+	}
+
+	c.decoded++
+	return bytes.ToLower(stored)
+}
+
+func TestValueManager_ValueCodec(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	manager, err := newValueManager(dir, 1024*32, 0, RetryPolicy{}, true)
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	codec := &upperCodec{}
+	manager.codec = codec
+
+	value := []byte("value one")
+	upperFileId, upperOffset, upperSize, err := manager.Write([]byte("upper/key"), value)
+	assert.NoError(t, err)
+	plainFileId, plainOffset, plainSize, err := manager.Write([]byte("plain/key"), value)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, codec.encoded)
+
+	read, err := manager.Read([]byte("upper/key"), upperFileId, upperOffset, upperSize)
+	assert.NoError(t, err)
+	assert.Equal(t, value, read)
+	read, err = manager.Read([]byte("plain/key"), plainFileId, plainOffset, plainSize)
+	assert.NoError(t, err)
+	assert.Equal(t, value, read)
+	assert.Equal(t, 1, codec.decoded)
+
+	// The encoded value is what is stored, and what the checksum is validated against.
+	file, err := manager.acquire(upperFileId)
+	assert.NoError(t, err)
+	defer manager.release(file)
+
+	stored, err := file.Read(upperOffset, upperSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("VALUE ONE"), stored)
+
+	stored, err = file.Read(plainOffset, plainSize)
+	assert.NoError(t, err)
+	assert.Equal(t, value, stored)
+
+	// A corrupt value might not be something the codec can decode, so the stored bytes are
+	// returned without decoding them.
+	_, err = file.File.WriteAt([]byte("X"), int64(upperOffset+valueHeaderSize))
+	assert.NoError(t, err)
+	manager.ignoreChecksumErrors, file.IgnoreChecksumErrors = true, true
+
+	read, err = manager.Read([]byte("upper/key"), upperFileId, upperOffset, upperSize)
+	assert.True(t, errors.Is(err, ErrValueChecksumIgnored))
+	assert.Equal(t, []byte("XALUE ONE"), read)
+	assert.Equal(t, 1, codec.decoded)
 }
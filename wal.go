@@ -1,10 +1,22 @@
 package lsmtree
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/elliotcourant/buffers"
+	"hash/fnv"
+	"io"
 	"os"
 	"path"
+	"sync"
+)
+
+var (
+	// ErrBadTransactionChecksum is returned when a transaction is read from a WAL segment but the
+	// checksum stored with it does not match the transaction's data.
+	ErrBadTransactionChecksum = errors.New("bad transaction checksum")
 )
 
 type (
@@ -21,6 +33,36 @@ type (
 		// last transaction committed to it. (see Options)
 		MaxWALSegmentSize uint64
 
+		// PreallocSize is the size that new segment files are created with. Segments will be grown
+		// towards the MaxWALSegmentSize as they fill up. (see Options)
+		PreallocSize uint64
+
+		// ShouldRotate is an optional hook that is called after every transaction is appended with
+		// the number of bytes used in the current segment and the segment's total size. If it
+		// returns true then a new segment will be started for the next transaction. Segments are
+		// always rotated when they run out of space regardless of this hook. (see Options)
+		ShouldRotate func(used, capacity int64) bool
+
+		// Cipher is used to encrypt the transactions written to segments when it is not nil. (see
+		// Options)
+		Cipher cipher.AEAD
+
+		// Logger is used to report when segments are rotated, grown or recovered. (see Options)
+		Logger Logger
+
+		// lock must be held while the currentSegment is being changed or used.
+		lock sync.Mutex
+
+		// retry is the policy used for writes to the WAL segments that are opened. (see Options)
+		retry RetryPolicy
+
+		// syncDirectory is true if the directory should be synced after a new segment is created.
+		// (see Options)
+		syncDirectory bool
+
+		// nextSegmentId is the segmentId that will be used the next time a new segment is created.
+		nextSegmentId uint64
+
 		// currentSegment is the WAL segment that is currently being used for all transactions. As
 		// transactions are committed there are appended here. Once this segment reaches a max size
 		// then a new segment will be created.
@@ -40,8 +82,38 @@ type (
 		// left in the file.
 		Space freeSpace
 
-		// File is just an accessor for the actual data on the disk for the WAL segment.
+		// Size is the total size of the segment file. The end of the data written to the segment
+		// is always at the end of the file.
+		Size int64
+
+		// File is just an accessor for the actual data on the disk for the WAL segment. Writes past
+		// the Size of the segment are refused.
 		File ReaderWriterAt
+
+		// Retry is the policy used when a write to the file fails with a transient error. The
+		// zero value of the policy will not retry writes.
+		Retry RetryPolicy
+
+		// Cipher is used to encrypt the changes of each transaction when it is not nil. The fixed
+		// fields at the start of the transaction are not encrypted so that the HeapId and the
+		// ValueFileId can still be updated in place. (see UpdateTransaction)
+		Cipher cipher.AEAD
+
+		// index maps the id of every transaction in the segment to the offset of its header so
+		// that a transaction can be found without scanning all of the headers. It is built when
+		// an existing segment is recovered and kept up to date as transactions are appended.
+		indexLock sync.Mutex
+		index     map[uint64]int64
+
+		// recovered is true if the stored free space of the segment did not match its headers
+		// when it was opened. Either the segment was not synced or it had a torn transaction that
+		// was truncated.
+		recovered bool
+
+		// syncErr is the error from the first sync of the file that failed. Once a sync has failed
+		// the writes before it might have been lost even if a later sync succeeds, so nothing
+		// written to the segment can be considered durable again.
+		syncErr error
 	}
 
 	// walTransaction represents a single batch of changes that must be all committed to the state
@@ -82,11 +154,31 @@ type (
 		Key Key
 
 		// Value is the value we want to store in the database. This will be nil if we are deleting
-		// a key.
+		// a key. The value of a set is never nil once it has been decoded, setting a key to an
+		// empty value is decoded as an empty slice so that it is never mistaken for a delete.
 		Value []byte
+
+		// ValueLocation is where the value has already been written in the value files,
+		// including the number of bytes that were stored for it. If its FileId is 0 then the
+		// value has not been written yet and will need to be written when the transaction is
+		// replayed. This is only used for set changes.
+		ValueLocation ValueLocator
 	}
 )
 
+const (
+	// walTransactionHeaderSize is the size of each transaction header at the top of a segment.
+	walTransactionHeaderSize = 16
+
+	// walTransactionChecksumSize is the number of bytes that suffix every transaction's data in a
+	// segment. This is the 32-bit fnv checksum of the transaction. (see walTransactionChecksum)
+	walTransactionChecksumSize = 4
+
+	// walTransactionFixedSize is the number of bytes at the start of every encoded transaction for
+	// the Timestamp, the HeapId and the ValueFileId. These are never encrypted.
+	walTransactionFixedSize = 24
+)
+
 const (
 	// walTransactionChangeTypeSet indicates that the value is being set.
 	walTransactionChangeTypeSet walTransactionChangeType = iota
@@ -95,23 +187,530 @@ const (
 	walTransactionChangeTypeDelete
 )
 
-// newWalManager will create the WAL manager object.
-func newWalManager(directory string, maxWalSegmentSize uint64) (*walManager, error) {
+const (
+	// walTransactionChangeHasLocation is set in the change type byte of an encoded change when the
+	// change is followed by the location of its value in the value files.
+	walTransactionChangeHasLocation = 0x80
+)
+
+// newWalManager will create the WAL manager object. New segments will be created with the prealloc
+// size and grown until they reach the max segment size. If the prealloc size is 0 or larger than
+// the max segment size then segments will be created at the max segment size.
+func newWalManager(
+	directory string, maxWalSegmentSize, preallocSize uint64, retry RetryPolicy,
+	syncDirectory bool,
+) (*walManager, error) {
 	// Create/verify that the directory exists. If it does not exist then this will create it. If
 	// the dir does exist then nothing will happen here.
 	if err := newDirectory(directory); err != nil {
 		return nil, err
 	}
 
+	segmentIds, err := getFileIds(directory, FileTypeWAL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Segment ids start at 1. New transactions are never appended to segments that existed before
+	// the manager was created, a new segment is always started instead.
+	nextSegmentId := uint64(1)
+	if len(segmentIds) > 0 {
+		nextSegmentId = segmentIds[len(segmentIds)-1] + 1
+	}
+
+	if preallocSize == 0 || preallocSize > maxWalSegmentSize {
+		preallocSize = maxWalSegmentSize
+	}
+
 	return &walManager{
 		Directory:         directory,
 		MaxWALSegmentSize: maxWalSegmentSize,
+		PreallocSize:      preallocSize,
+		retry:             retry,
+		syncDirectory:     syncDirectory,
+		Logger:            noopLogger{},
+		nextSegmentId:     nextSegmentId,
 		currentSegment:    nil,
 	}, nil
 }
 
-// openWalSegment will open or create a wal segment file if it does not exist.
-func openWalSegment(directory string, segmentId uint64, size int32) (*walSegment, error) {
+// skipTo will make sure that no new segment is given an id lower than the one provided. This must
+// be called before any transactions are appended.
+func (w *walManager) skipTo(segmentId uint64) {
+	if w.nextSegmentId < segmentId {
+		w.nextSegmentId = segmentId
+	}
+}
+
+// Append will write the transaction to the current WAL segment. If there is no current segment, or
+// the current segment does not have enough space for the transaction, then a new segment will be
+// created and the transaction will be written there. If a ShouldRotate hook has been provided and
+// it returns true after the transaction has been written then the current segment will be
+// finished and the next transaction will start a new segment.
+func (w *walManager) Append(txn walTransaction) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.append(txn); err != nil {
+		return err
+	}
+
+	// The segment is already finished if the transaction was too large for a normal segment.
+	if w.currentSegment != nil && w.ShouldRotate != nil && w.ShouldRotate(w.currentSegmentSize()) {
+		return w.finishSegment()
+	}
+
+	return nil
+}
+
+// CurrentSegmentSize returns the number of bytes used in the current segment and the total size of
+// the current segment. If there is no current segment then both will be 0.
+func (w *walManager) CurrentSegmentSize() (used, capacity int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.currentSegmentSize()
+}
+
+// currentSegmentSize is the same as CurrentSegmentSize, but the lock must be held when this is
+// called.
+func (w *walManager) currentSegmentSize() (used, capacity int64) {
+	if w.currentSegment == nil {
+		return 0, 0
+	}
+
+	capacity = w.currentSegment.Size
+	return capacity - w.currentSegment.Space.Space(), capacity
+}
+
+// append will write the transaction to the current segment, growing or rotating the segment if
+// there is not enough space. If the transaction is too large to fit in a segment of the max
+// segment size then it is written to a new segment of its own that is grown just enough to hold
+// it, and that segment is finished straight away. The lock must be held when this is called.
+func (w *walManager) append(txn walTransaction) error {
+	rotated := false
+	if w.currentSegment == nil {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+		rotated = true
+	}
+
+	for {
+		err := w.appendOrGrow(txn)
+		if !errors.Is(err, ErrInsufficientSpace) {
+			return err
+		}
+
+		// A segment that was started for this transaction has already been grown as far as it
+		// can be, so starting another one would not help.
+		if rotated {
+			break
+		}
+
+		// The current segment is full, start a new one and try again.
+		if err = w.rotate(); err != nil {
+			return err
+		}
+		rotated = true
+	}
+
+	// Even an empty segment of the max size cannot hold the transaction. Grow the segment beyond
+	// the max size so that the transaction still fits, then finish the segment so that the next
+	// transaction starts a new one.
+	segment := w.currentSegment
+	size := segment.Size + w.needed(txn) - segment.Space.Space()
+	if err := segment.Grow(size); err != nil {
+		return err
+	}
+
+	w.Logger.Debugf(
+		"grew wal segment %d to %d bytes for a transaction larger than the max segment size",
+		segment.SegmentId, size,
+	)
+
+	if err := segment.Append(txn); err != nil {
+		return err
+	}
+
+	return w.finishSegment()
+}
+
+// appendOrGrow will write the transaction to the current segment. If there is not enough space
+// then the segment is grown, up to the max segment size, to make room for the transaction and it
+// is tried again. If there is still not enough space then ErrInsufficientSpace is returned. The
+// lock must be held when this is called.
+func (w *walManager) appendOrGrow(txn walTransaction) error {
+	err := w.currentSegment.Append(txn)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		return err
+	}
+
+	grown, err := w.grow(w.needed(txn))
+	if err != nil {
+		return err
+	} else if !grown {
+		return ErrInsufficientSpace
+	}
+
+	return w.currentSegment.Append(txn)
+}
+
+// needed returns the number of bytes that the transaction will take up in a segment, including its
+// header.
+func (w *walManager) needed(txn walTransaction) int64 {
+	return int64(
+		walTransactionHeaderSize + len(txn.Encode()) + walTransactionChecksumSize +
+			cipherOverhead(w.Cipher),
+	)
+}
+
+// grow will try to grow the current segment so that it has at least the number of bytes needed
+// free. The segment will at least double in size but will never grow beyond the max segment size.
+// If the segment could not be grown enough then false is returned and the segment is left as is.
+// The lock must be held when this is called.
+func (w *walManager) grow(needed int64) (bool, error) {
+	segment := w.currentSegment
+	maxSize := int64(w.MaxWALSegmentSize)
+
+	size := segment.Size * 2
+	if free := segment.Space.Space(); size-segment.Size+free < needed {
+		size = segment.Size + needed - free
+	}
+
+	if size > maxSize {
+		size = maxSize
+	}
+
+	// If we can't make enough room then there is no point in growing the segment.
+	if size <= segment.Size || size-segment.Size+segment.Space.Space() < needed {
+		return false, nil
+	}
+
+	if err := segment.Grow(size); err != nil {
+		// If the segment cannot grow safely then we can still move onto a new segment.
+		if errors.Is(err, ErrInsufficientSpace) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	w.Logger.Debugf("grew wal segment %d to %d bytes", segment.SegmentId, size)
+	return true, nil
+}
+
+// Rotate will finish the current segment (if there is one) and start a new segment that subsequent
+// transactions will be appended to. The ID of the new segment is returned. Any transaction being
+// appended while Rotate is called will be entirely in either the old or the new segment.
+func (w *walManager) Rotate() (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.rotate(); err != nil {
+		return 0, err
+	}
+
+	return w.currentSegment.SegmentId, nil
+}
+
+// rotate will sync and close the current segment (if there is one) and open a new segment that
+// subsequent transactions will be appended to. The lock must be held when this is called.
+func (w *walManager) rotate() error {
+	if err := w.finishSegment(); err != nil {
+		return err
+	}
+
+	segment, err := openWalSegmentWithCipher(
+		w.Directory, w.nextSegmentId, int32(w.PreallocSize), w.syncDirectory, w.Cipher,
+	)
+	if err != nil {
+		return err
+	}
+	segment.Retry = w.retry
+
+	w.nextSegmentId++
+	w.currentSegment = segment
+	w.Logger.Infof("started wal segment %d", segment.SegmentId)
+
+	return nil
+}
+
+// finishSegment will sync and close the current segment if there is one. The next transaction
+// appended will start a new segment. The lock must be held when this is called.
+func (w *walManager) finishSegment() error {
+	if w.currentSegment == nil {
+		return nil
+	}
+
+	if err := w.currentSegment.Sync(); err != nil {
+		return err
+	}
+
+	if err := w.currentSegment.Close(); err != nil {
+		return err
+	}
+
+	w.currentSegment = nil
+
+	return nil
+}
+
+// iterate will call fn with every transaction in the WAL in the order that they were written,
+// starting with the oldest segment. If fn returns an error then iteration will stop and the error
+// will be returned.
+func (w *walManager) iterate(fn func(txn walTransaction) error) error {
+	segmentIds, err := getFileIds(w.Directory, FileTypeWAL)
+	if err != nil {
+		return err
+	}
+
+	for _, segmentId := range segmentIds {
+		transactions, err := w.getSegmentTransactions(segmentId)
+		if err != nil {
+			return err
+		}
+
+		for _, txn := range transactions {
+			if err := fn(txn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getSegmentTransactions will return all of the transactions in the segment specified. If the
+// segment is the current segment then the in memory segment is used, otherwise the segment is read
+// from the disk.
+func (w *walManager) getSegmentTransactions(segmentId uint64) (
+	transactions []walTransaction, err error,
+) {
+	err = w.withSegment(segmentId, func(segment *walSegment) (err error) {
+		transactions, err = segment.GetTransactions()
+		return err
+	})
+
+	return transactions, err
+}
+
+// getSegmentLastTransactionId will return the id of the last transaction in the segment specified
+// by only reading the segment's headers. If the segment does not have any transactions then ok
+// will be false.
+func (w *walManager) getSegmentLastTransactionId(segmentId uint64) (
+	transactionId uint64, ok bool, err error,
+) {
+	err = w.withSegment(segmentId, func(segment *walSegment) (err error) {
+		transactionId, ok, err = segment.getLastTransactionId()
+		return err
+	})
+
+	return transactionId, ok, err
+}
+
+// LastTransaction will return the last transaction that was appended to the WAL. The headers of
+// the newest segments are read to find the last segment with a transaction, and then only that
+// segment is read. If the WAL does not have any transactions then ok will be false.
+func (w *walManager) LastTransaction() (txn walTransaction, ok bool, err error) {
+	segmentId, _, ok, err := w.lastTransactionSegment()
+	if err != nil || !ok {
+		return txn, false, err
+	}
+
+	transactions, err := w.getSegmentTransactions(segmentId)
+	if err != nil {
+		return txn, false, err
+	}
+
+	return transactions[len(transactions)-1], true, nil
+}
+
+// LastTransactionId will return the id of the last transaction that was appended to the WAL. This
+// only reads the headers of the newest segments, none of the transactions are read. If the WAL does
+// not have any transactions then ok will be false.
+func (w *walManager) LastTransactionId() (transactionId uint64, ok bool, err error) {
+	_, transactionId, ok, err = w.lastTransactionSegment()
+	return transactionId, ok, err
+}
+
+// lastTransactionSegment will return the newest segment that has a transaction in it, along with
+// the id of the last transaction in that segment. If no segment has a transaction then ok will be
+// false.
+func (w *walManager) lastTransactionSegment() (
+	segmentId, transactionId uint64, ok bool, err error,
+) {
+	segmentIds, err := getFileIds(w.Directory, FileTypeWAL)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	// Segments can be empty if they were rotated before anything was appended to them, so keep
+	// going back until one of them has a transaction.
+	for i := len(segmentIds) - 1; i >= 0; i-- {
+		if transactionId, ok, err = w.getSegmentLastTransactionId(segmentIds[i]); err != nil {
+			return 0, 0, false, err
+		} else if ok {
+			return segmentIds[i], transactionId, true, nil
+		}
+	}
+
+	return 0, 0, false, nil
+}
+
+// withSegment will call fn with the segment specified. If the segment is the current segment then
+// the in memory segment is used while the lock is held, otherwise the segment is opened from the
+// disk and closed once fn returns.
+func (w *walManager) withSegment(segmentId uint64, fn func(segment *walSegment) error) error {
+	w.lock.Lock()
+	if w.currentSegment != nil && w.currentSegment.SegmentId == segmentId {
+		defer w.lock.Unlock()
+		return fn(w.currentSegment)
+	}
+	w.lock.Unlock()
+
+	// Segments other than the current segment are not written to anymore. They were synced when
+	// they were rotated so the free space stored in the file is accurate.
+	segment, err := openWalSegmentWithCipher(
+		w.Directory, segmentId, int32(w.MaxWALSegmentSize), false, w.Cipher,
+	)
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+
+	if segment.recovered {
+		w.Logger.Warnf(
+			"recovered wal segment %d, %d transactions are intact", segmentId, len(segment.index),
+		)
+	}
+
+	return fn(segment)
+}
+
+// ReadFrom will return an iterator over every transaction with an id greater than or equal to the
+// id provided, in the order that they were appended. If there is no transaction with that exact id
+// then the iterator will start at the next transaction with a higher id. Segments that only have
+// older transactions are skipped by reading just their headers. Transaction ids are expected to
+// increase as they are appended.
+func (w *walManager) ReadFrom(transactionId uint64) (*walIterator, error) {
+	segmentIds, err := getFileIds(w.Directory, FileTypeWAL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip every segment whose last transaction is before the one we want.
+	for len(segmentIds) > 0 {
+		lastTransactionId, ok, err := w.getSegmentLastTransactionId(segmentIds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if ok && lastTransactionId >= transactionId {
+			break
+		}
+
+		segmentIds = segmentIds[1:]
+	}
+
+	itr := &walIterator{
+		manager:    w,
+		segmentIds: segmentIds,
+	}
+
+	// Move to the first transaction with an id that is at least the one requested.
+	for itr.Next(); itr.Valid() && itr.Transaction().TransactionId < transactionId; itr.Next() {
+	}
+
+	return itr, itr.Err()
+}
+
+// walIterator moves through the transactions of a set of WAL segments one segment at a time. The
+// iterator must be moved to its first transaction by calling Next.
+type walIterator struct {
+	manager      *walManager
+	segmentIds   []uint64
+	transactions []walTransaction
+	err          error
+}
+
+// Next will move the iterator to the next transaction, loading the next segment if every
+// transaction in the current segment has been read.
+func (i *walIterator) Next() {
+	if len(i.transactions) > 0 {
+		i.transactions = i.transactions[1:]
+	}
+
+	for len(i.transactions) == 0 && len(i.segmentIds) > 0 && i.err == nil {
+		i.transactions, i.err = i.manager.getSegmentTransactions(i.segmentIds[0])
+		i.segmentIds = i.segmentIds[1:]
+	}
+}
+
+// Valid will return true if the iterator is positioned on a transaction. If reading a segment
+// failed then this will return false and the error can be retrieved with Err.
+func (i *walIterator) Valid() bool {
+	return i.err == nil && len(i.transactions) > 0
+}
+
+// Transaction returns the transaction that the iterator is currently positioned on. This should
+// only be called when Valid returns true.
+func (i *walIterator) Transaction() walTransaction {
+	return i.transactions[0]
+}
+
+// Err will return the error that stopped the iterator, if there was one.
+func (i *walIterator) Err() error {
+	return i.err
+}
+
+// Close will sync and close the current WAL segment. The segment is still closed if the sync fails.
+func (w *walManager) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.currentSegment == nil {
+		return nil
+	}
+
+	syncErr := w.currentSegment.Sync()
+	err := w.currentSegment.Close()
+	w.currentSegment = nil
+
+	if syncErr != nil {
+		return syncErr
+	}
+
+	return err
+}
+
+// Sync will flush the current WAL segment to the disk. If there is no current segment then nothing
+// happens and nil is returned.
+func (w *walManager) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.currentSegment == nil {
+		return nil
+	}
+
+	return w.currentSegment.Sync()
+}
+
+// openWalSegment will open or create a wal segment file if it does not exist. If the file is created
+// and syncDirectory is true then the directory will be synced so that the new file is durable.
+func openWalSegment(
+	directory string, segmentId uint64, size int32, syncDirectory bool,
+) (*walSegment, error) {
+	return openWalSegmentWithCipher(directory, segmentId, size, syncDirectory, nil)
+}
+
+// openWalSegmentWithCipher is the same as openWalSegment, but the transactions in the segment are
+// encrypted with the cipher provided. The cipher must be known when the segment is opened so that
+// an existing segment can be recovered.
+func openWalSegmentWithCipher(
+	directory string, segmentId uint64, size int32, syncDirectory bool, c cipher.AEAD,
+) (*walSegment, error) {
 	filePath := path.Join(directory, getWalSegmentFileName(segmentId))
 
 	// We want to be able to read/write the file. If the file does not exist we want to create it.
@@ -124,39 +723,245 @@ func openWalSegment(directory string, segmentId uint64, size int32) (*walSegment
 
 	file, err := os.OpenFile(filePath, flags, mode)
 	if err != nil {
-		return nil, err
+		return nil, newFileError(ErrOpeningFile, err, "opening wal segment %d", segmentId)
 	}
 
 	// If we somehow cannot read the stat for the file then something is very wrong. We need to do
 	// this because we need to know what offset to start with when appending to the file.
 	stat, err := file.Stat()
 	if err != nil {
-		return nil, err
+		_ = file.Close()
+		return nil, newFileError(ErrOpeningFile, err, "reading stat of wal segment %d", segmentId)
 	}
 
 	var space freeSpace
+	fileSize := stat.Size()
 
 	// If the current file size less than or equal to 8 then we know it's a new file and we need to
 	// create the freeSpace map. This is because we should be allocating files of a size large
 	// enough to contain the map AND the data.
-	if stat.Size() <= 8 {
+	if fileSize <= 8 {
 		space = newFreeSpace(size)
+		fileSize = int64(size)
+
+		// Write the freeSpace map and allocate the entire file up front. That way the size of the
+		// file will always be the size of the segment when it is reopened.
+		if _, err := file.WriteAt(space.Encode(), 0); err != nil {
+			_ = file.Close()
+			return nil, newFileError(
+				ErrWritingFile, err, "writing free space of wal segment %d", segmentId,
+			)
+		}
+
+		if err := file.Truncate(fileSize); err != nil {
+			_ = file.Close()
+			return nil, newFileError(
+				ErrWritingFile, err, "allocating wal segment %d", segmentId,
+			)
+		}
+
+		// The file's directory entry is not durable until the directory itself has been synced.
+		if syncDirectory {
+			if err := directorySyncer(directory); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+		}
 	} else {
 		spaceBytes := make([]byte, 8)
 		if n, err := file.ReadAt(spaceBytes, 0); err != nil {
-			return nil, err
+			_ = file.Close()
+			return nil, newFileError(
+				ErrReadingFile, err, "reading free space of wal segment %d", segmentId,
+			)
 		} else if n < 8 {
-			return nil, ErrCantReadFreeSpace
+			_ = file.Close()
+			return nil, fmt.Errorf(
+				"reading free space of wal segment %d: %w", segmentId, ErrCantReadFreeSpace,
+			)
 		}
 
 		space = newFreeSpaceFromBytes(spaceBytes)
 	}
 
-	return &walSegment{
+	segment := &walSegment{
 		SegmentId: segmentId,
 		Space:     space,
-		File:      file,
-	}, nil
+		Size:      fileSize,
+		File:      newBoundedFile(file, fileSize),
+		Cipher:    c,
+		index:     map[uint64]int64{},
+	}
+
+	// If the segment already existed then it might have been torn by a crash while a transaction
+	// was being appended. Make sure that anything appended to it later is not built on garbage.
+	if stat.Size() > 8 {
+		if err := segment.recover(); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+
+	return segment, nil
+}
+
+// recover will walk the transaction headers of the segment and find the last transaction that was
+// completely written. Because the freeSpace map is only written when the segment is synced the
+// headers are read until an empty header is found rather than only up to the stored header
+// offset. The first header that points outside of the expected data range or whose data does not
+// match its checksum is treated as the end of the segment. Anything after that point is cleared
+// and the freeSpace map is re-seeded to start at that point.
+//
+// If a Grow was interrupted then the file already has its new size but some or all of the headers
+// still point to where the data was before the grow. Those headers are accepted as long as they
+// are all off by the same amount, and then the grow is finished by copying their data to the end
+// of the file and pointing them at the copy.
+func (w *walSegment) recover() error {
+	storedSpace := w.Space
+	headerOffset, dataOffset := int64(8), w.Size
+	header := make([]byte, walTransactionHeaderSize)
+
+	// grown is how far the data was moved by an interrupted Grow, and moved are the offsets of the
+	// headers that still point to where the data was before it was moved.
+	grown, moved := int64(0), make([]int64, 0)
+	for headerOffset+walTransactionHeaderSize <= dataOffset {
+		if _, err := w.File.ReadAt(header, headerOffset); err != nil {
+			return newFileError(
+				ErrReadingFile, err, "reading headers of wal segment %d", w.SegmentId,
+			)
+		}
+
+		transactionId := binary.BigEndian.Uint64(header[0:8])
+		start := int64(binary.BigEndian.Uint32(header[8:12]))
+		end := int64(binary.BigEndian.Uint32(header[12:16]))
+
+		// Data is allocated from the back of the file immediately before the data of the previous
+		// transaction. If the header does not point there, or to where that was before the file
+		// was grown, then it was not completely written. The first header that points before
+		// where its data should be is only taken to be from an interrupted grow if its data is
+		// intact, and after that every other header must be off by the same amount or not at all.
+		shift := dataOffset - end
+		if shift < 0 || (shift != 0 && grown != 0 && shift != grown) {
+			break
+		}
+
+		if transactionId == 0 || start+shift < headerOffset+walTransactionHeaderSize ||
+			end-start < walTransactionChecksumSize {
+			break
+		}
+
+		data := make([]byte, end-start)
+		if _, err := w.File.ReadAt(data, start); err != nil {
+			return newFileError(
+				ErrReadingFile, err, "reading transaction %d from wal segment %d",
+				transactionId, w.SegmentId,
+			)
+		}
+
+		if _, err := w.decodeTransactionData(transactionId, data); err != nil {
+			// If not even the first transaction can be decrypted then the wrong key is much more
+			// likely than a torn write. Refuse to open the segment rather than truncating it.
+			if errors.Is(err, ErrDecrypting) && headerOffset == 8 {
+				return fmt.Errorf("recovering wal segment %d: %w", w.SegmentId, err)
+			}
+
+			break
+		}
+
+		if shift != 0 {
+			grown = shift
+			moved = append(moved, headerOffset)
+		}
+
+		w.index[transactionId] = headerOffset
+		headerOffset += walTransactionHeaderSize
+		dataOffset = start + shift
+	}
+
+	if err := w.finishGrow(grown, moved); err != nil {
+		return err
+	}
+
+	w.Space = newFreeSpaceFromOffsets(headerOffset, dataOffset)
+	if w.Space == storedSpace && len(moved) == 0 {
+		return nil
+	}
+	w.recovered = true
+
+	// Clear any headers after the last valid transaction so that they cannot be mistaken for
+	// valid transactions once new transactions have been appended after them.
+	empty := make([]byte, walTransactionHeaderSize)
+	for offset := headerOffset; offset+walTransactionHeaderSize <= dataOffset; {
+		if _, err := w.File.ReadAt(header, offset); err != nil {
+			return newFileError(
+				ErrReadingFile, err, "reading headers of wal segment %d", w.SegmentId,
+			)
+		}
+
+		if binary.BigEndian.Uint64(header[0:8]) == 0 {
+			break
+		}
+
+		if _, err := w.File.WriteAt(empty, offset); err != nil {
+			return newFileError(
+				ErrWritingFile, err, "clearing headers of wal segment %d", w.SegmentId,
+			)
+		}
+
+		offset += walTransactionHeaderSize
+	}
+
+	return w.Sync()
+}
+
+// finishGrow will finish a Grow that was interrupted. The data of each of the headers provided is
+// copied grown bytes further into the file, and only once every copy is on the disk are the
+// headers pointed at the copies. Grow never copies data over itself, so the data the headers point
+// to is still intact, and if this is interrupted as well then it is simply done again.
+func (w *walSegment) finishGrow(grown int64, moved []int64) error {
+	if len(moved) == 0 {
+		return nil
+	}
+
+	headers := make([][]byte, len(moved))
+	for i, offset := range moved {
+		header := make([]byte, walTransactionHeaderSize)
+		if _, err := w.File.ReadAt(header, offset); err != nil {
+			return newFileError(
+				ErrReadingFile, err, "reading headers of wal segment %d", w.SegmentId,
+			)
+		}
+
+		start := int64(binary.BigEndian.Uint32(header[8:12]))
+		end := int64(binary.BigEndian.Uint32(header[12:16]))
+		data := make([]byte, end-start)
+		if _, err := w.File.ReadAt(data, start); err != nil {
+			return newFileError(ErrReadingFile, err, "reading wal segment %d", w.SegmentId)
+		}
+
+		if _, err := w.File.WriteAt(data, start+grown); err != nil {
+			return newFileError(ErrWritingFile, err, "growing wal segment %d", w.SegmentId)
+		}
+
+		binary.BigEndian.PutUint32(header[8:12], uint32(start+grown))
+		binary.BigEndian.PutUint32(header[12:16], uint32(end+grown))
+		headers[i] = header
+	}
+
+	// The copies must be on the disk before any headers point to them.
+	if err := w.syncFile(); err != nil {
+		return err
+	}
+
+	for i, offset := range moved {
+		if _, err := w.File.WriteAt(headers[i], offset); err != nil {
+			return newFileError(
+				ErrWritingFile, err, "writing headers of wal segment %d", w.SegmentId,
+			)
+		}
+	}
+
+	return nil
 }
 
 // Append adds a transaction entry to the WAL segment. A transaction header is inserted at the top
@@ -166,13 +971,16 @@ func openWalSegment(directory string, segmentId uint64, size int32) (*walSegment
 func (w *walSegment) Append(txn walTransaction) (err error) {
 	// The header will always be 16 bytes and consists of a single 64 bit integer and two 32 bit
 	// integers.
-	header := make([]byte, 16)
+	header := make([]byte, walTransactionHeaderSize)
 
 	// Encode the transactions changes to be written to the file.
-	data := txn.Encode()
+	data, err := w.encodeTransactionData(txn)
+	if err != nil {
+		return err
+	}
 
 	// Allocate space for the item to be written to the WAL.
-	ok, headerOffset, dataOffset := w.Space.Allocate(header, data)
+	ok, headerOffset, dataOffset := w.Space.Allocate(len(header), len(data))
 	if !ok {
 		return ErrInsufficientSpace
 	}
@@ -183,20 +991,129 @@ func (w *walSegment) Append(txn walTransaction) (err error) {
 	binary.BigEndian.PutUint32(header[8:12], uint32(dataOffset))
 	binary.BigEndian.PutUint32(header[12:16], uint32(dataOffset+int64(len(data))))
 
-	// Write the header to the file.
-	if _, err = w.File.WriteAt(header, headerOffset); err != nil {
+	// Write the header to the file. The space for the transaction has already been allocated so if
+	// a write needs to be retried it will be retried at the same offset.
+	if err = w.Retry.Do(func() (err error) {
+		_, err = w.File.WriteAt(header, headerOffset)
 		return err
+	}); err != nil {
+		w.releaseIfDiskFull(err, len(header), len(data), headerOffset, dataOffset)
+		return newFileError(
+			ErrWritingFile, err, "writing header of transaction %d to wal segment %d",
+			txn.TransactionId, w.SegmentId,
+		)
 	}
 
 	// Write the actual transaction data.
-	if _, err = w.File.WriteAt(data, dataOffset); err != nil {
+	if err = w.Retry.Do(func() (err error) {
+		_, err = w.File.WriteAt(data, dataOffset)
 		return err
+	}); err != nil {
+		w.releaseIfDiskFull(err, len(header), len(data), headerOffset, dataOffset)
+		return newFileError(
+			ErrWritingFile, err, "writing transaction %d to wal segment %d",
+			txn.TransactionId, w.SegmentId,
+		)
+	}
+
+	w.indexLock.Lock()
+	w.index[txn.TransactionId] = headerOffset
+	w.indexLock.Unlock()
+
+	// Persist the freeSpace map so that the offsets stored in the file are never behind the data
+	// that has been written to it. If transactions are being appended at the same time this might
+	// store a slightly older map, but recover will still find every complete transaction.
+	if err = w.Retry.Do(func() (err error) {
+		_, err = w.File.WriteAt(w.Space.Encode(), 0)
+		return err
+	}); err != nil {
+		return newFileError(
+			ErrWritingFile, err, "writing free space of wal segment %d", w.SegmentId,
+		)
 	}
 
 	// Everything worked, we can return nil.
 	return nil
 }
 
+// releaseIfDiskFull will give back the space allocated for a transaction if writing it failed
+// because the disk is full. Nothing points to the transaction yet, so if it was the most recent
+// allocation the space can be reused by the next transaction that is appended.
+func (w *walSegment) releaseIfDiskFull(
+	err error, headerSize, dataSize int, headerOffset, dataOffset int64,
+) {
+	if isDiskFullError(err) {
+		w.Space.Release(headerSize, dataSize, headerOffset, dataOffset)
+	}
+}
+
+// Grow will increase the size of the segment file to the size provided. Because data is written
+// from the end of the file, all of the data in the segment is moved to the new end of the file and
+// the headers are updated to point to the new location. The data is copied to a region of the file
+// that does not overlap with where it currently is, so if the grow is interrupted every header will
+// still point to a complete copy of its transaction and the grow is finished when the segment is
+// recovered. If the new size does not leave room for a complete copy then ErrInsufficientSpace is
+// returned. No transactions can be appended while the
+// segment is being grown.
+func (w *walSegment) Grow(size int64) error {
+	headerOffset, dataOffset := w.Space.Current()
+	delta := size - w.Size
+	used := w.Size - dataOffset
+	if delta < used {
+		return ErrInsufficientSpace
+	}
+
+	// Allocate the new space for the file.
+	if truncater, ok := w.File.(interface{ Truncate(int64) error }); ok {
+		if err := truncater.Truncate(size); err != nil {
+			return newFileError(ErrWritingFile, err, "growing wal segment %d", w.SegmentId)
+		}
+	}
+
+	// Copy the data to the new end of the file.
+	data := make([]byte, used)
+	if _, err := w.File.ReadAt(data, dataOffset); err != nil {
+		return newFileError(ErrReadingFile, err, "reading wal segment %d", w.SegmentId)
+	}
+
+	if err := w.Retry.Do(func() (err error) {
+		_, err = w.File.WriteAt(data, dataOffset+delta)
+		return err
+	}); err != nil {
+		return newFileError(ErrWritingFile, err, "growing wal segment %d", w.SegmentId)
+	}
+
+	// The copy must be on the disk before any headers point to it.
+	if err := w.syncFile(); err != nil {
+		return err
+	}
+
+	// Point all of the headers to the new location of their data.
+	headers := make([]byte, headerOffset-8)
+	if _, err := w.File.ReadAt(headers, 8); err != nil {
+		return newFileError(ErrReadingFile, err, "reading headers of wal segment %d", w.SegmentId)
+	}
+
+	for i := 0; i < len(headers); i += walTransactionHeaderSize {
+		start := int64(binary.BigEndian.Uint32(headers[i+8:i+12])) + delta
+		end := int64(binary.BigEndian.Uint32(headers[i+12:i+16])) + delta
+		binary.BigEndian.PutUint32(headers[i+8:i+12], uint32(start))
+		binary.BigEndian.PutUint32(headers[i+12:i+16], uint32(end))
+	}
+
+	if err := w.Retry.Do(func() (err error) {
+		_, err = w.File.WriteAt(headers, 8)
+		return err
+	}); err != nil {
+		return newFileError(ErrWritingFile, err, "writing headers of wal segment %d", w.SegmentId)
+	}
+
+	w.Space = newFreeSpaceFromOffsets(headerOffset, dataOffset+delta)
+	w.Size = size
+
+	return w.Sync()
+}
+
 // UpdateTransaction will update the heapId and valueFileId's of the specified transaction
 // within the WAL segment. If the transaction could not be found then ok will be false. If the write
 // failed then an error will be returned.
@@ -228,7 +1145,10 @@ func (w *walSegment) UpdateTransaction(transactionId, heapId, valueFileId uint64
 		// Something went wrong writing to the file, we still want to return true to indicate that
 		// the transaction is in fact in this file, but that something is stopping the change from
 		// being made.
-		return true, err
+		return true, newFileError(
+			ErrWritingFile, err, "updating transaction %d in wal segment %d",
+			transactionId, w.SegmentId,
+		)
 	}
 
 	// Everything worked, we can return true because we found the transaction.
@@ -236,43 +1156,96 @@ func (w *walSegment) UpdateTransaction(transactionId, heapId, valueFileId uint64
 }
 
 // Sync will flush the changes made to the wal file to the disk if the file interface implements
-// the CanSync interface. If it does not then nothing happens and nil is returned.
+// the CanSync interface. If it does not then nothing happens and nil is returned. If a sync of the
+// segment has ever failed then that error is returned again without syncing.
 func (w *walSegment) Sync() error {
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+
 	// Before syncing the file make sure to write the current freeSpace map to the
 	// file as well.
 	if _, err := w.File.WriteAt(w.Space.Encode(), 0); err != nil {
-		return err
+		return newFileError(
+			ErrWritingFile, err, "writing free space of wal segment %d", w.SegmentId,
+		)
+	}
+
+	return w.syncFile()
+}
+
+// syncFile will sync the segment's file if it implements CanSync. A failed sync is never retried,
+// the operating system may have already dropped the writes that failed and a second sync would
+// succeed without them ever reaching the disk. Instead the error is kept and returned by every
+// sync after it.
+func (w *walSegment) syncFile() error {
+	if w.syncErr != nil {
+		return w.syncErr
 	}
 
 	if canSync, ok := w.File.(CanSync); ok {
-		return canSync.Sync()
+		if err := canSync.Sync(); err != nil {
+			w.syncErr = newFileError(ErrWritingFile, err, "syncing wal segment %d", w.SegmentId)
+			return w.syncErr
+		}
 	}
 
 	return nil
 }
 
-func (w *walSegment) getTransactionDataLocation(txnId uint64) (ok bool, start, end int64, err error) {
-	headerStart := int64(8)
-	headerEnd, _ := w.Space.Current()
-	headers := make([]byte, headerEnd-headerStart)
-	if _, err := w.File.ReadAt(headers, headerStart); err != nil {
-		return false, 0, 0, err
+// Close will close the WAL segment's file if the file interface implements the io.Closer interface.
+// The segment is not synced before it is closed.
+func (w *walSegment) Close() error {
+	if closer, ok := w.File.(io.Closer); ok {
+		return closer.Close()
 	}
 
-	for i := 0; i < len(headers); i += 16 {
-		transactionId := binary.BigEndian.Uint64(headers[i : i+8])
-		if txnId != transactionId {
-			continue
-		}
+	return nil
+}
 
-		ok = true
-		start = int64(binary.BigEndian.Uint32(headers[i+8 : i+8+4]))
-		end = int64(binary.BigEndian.Uint32(headers[i+8+4 : i+8+4+4]))
+// getTransactionDataLocation will return the start and end offsets of the data for the transaction
+// specified. Only the transaction's own header is read, the header is found using the segment's
+// index. If the transaction is not in this segment then ok will be false.
+func (w *walSegment) getTransactionDataLocation(txnId uint64) (
+	ok bool, start, end int64, err error,
+) {
+	w.indexLock.Lock()
+	headerOffset, ok := w.index[txnId]
+	w.indexLock.Unlock()
+	if !ok {
+		return false, 0, 0, nil
+	}
 
-		return
+	header := make([]byte, walTransactionHeaderSize)
+	if _, err := w.File.ReadAt(header, headerOffset); err != nil {
+		return false, 0, 0, newFileError(
+			ErrReadingFile, err, "reading header of transaction %d in wal segment %d",
+			txnId, w.SegmentId,
+		)
 	}
 
-	return
+	start = int64(binary.BigEndian.Uint32(header[8:12]))
+	end = int64(binary.BigEndian.Uint32(header[12:16]))
+
+	return true, start, end, nil
+}
+
+// getLastTransactionId will return the id of the last transaction appended to the segment. If the
+// segment does not have any transactions yet then ok will be false.
+func (w *walSegment) getLastTransactionId() (transactionId uint64, ok bool, err error) {
+	headerEnd, _ := w.Space.Current()
+	if headerEnd-walTransactionHeaderSize < 8 {
+		return 0, false, nil
+	}
+
+	header := make([]byte, walTransactionHeaderSize)
+	if _, err := w.File.ReadAt(header, headerEnd-walTransactionHeaderSize); err != nil {
+		return 0, false, newFileError(
+			ErrReadingFile, err, "reading headers of wal segment %d", w.SegmentId,
+		)
+	}
+
+	return binary.BigEndian.Uint64(header[0:8]), true, nil
 }
 
 // GetTransactions will return an array of transactions and their changes in the order that they
@@ -283,11 +1256,13 @@ func (w *walSegment) GetTransactions() ([]walTransaction, error) {
 
 	headers := make([]byte, headerEnd-headerStart)
 	if _, err := w.File.ReadAt(headers, headerStart); err != nil {
-		return nil, err
+		return nil, newFileError(
+			ErrReadingFile, err, "reading headers of wal segment %d", w.SegmentId,
+		)
 	}
 
 	transactions := make([]walTransaction, 0)
-	for i := 0; i < len(headers); i += 16 {
+	for i := 0; i < len(headers); i += walTransactionHeaderSize {
 		transactionId := binary.BigEndian.Uint64(headers[i : i+8])
 		start := binary.BigEndian.Uint32(headers[i+8 : i+8+4])
 		end := binary.BigEndian.Uint32(headers[i+8+4 : i+8+4+4])
@@ -297,10 +1272,20 @@ func (w *walSegment) GetTransactions() ([]walTransaction, error) {
 
 		changeBuffer := make([]byte, end-start)
 		if _, err := w.File.ReadAt(changeBuffer, int64(start)); err != nil {
-			return nil, err
+			return nil, newFileError(
+				ErrReadingFile, err, "reading transaction %d from wal segment %d",
+				transactionId, w.SegmentId,
+			)
+		}
+
+		encoded, err := w.decodeTransactionData(transactionId, changeBuffer)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"reading transaction %d from wal segment %d: %w", transactionId, w.SegmentId, err,
+			)
 		}
 
-		transaction.Decode(changeBuffer)
+		transaction.Decode(encoded)
 
 		transactions = append(transactions, *transaction)
 	}
@@ -308,6 +1293,98 @@ func (w *walSegment) GetTransactions() ([]walTransaction, error) {
 	return transactions, nil
 }
 
+// encodeTransactionData returns the data that is written to the segment for the transaction. This
+// is the encoded transaction suffixed with its checksum so that a partially written transaction
+// can be detected when the segment is recovered. If the segment has a cipher then everything after
+// the fixed fields is encrypted, including the checksum.
+func (w *walSegment) encodeTransactionData(txn walTransaction) ([]byte, error) {
+	encoded := txn.Encode()
+	data := make([]byte, len(encoded), len(encoded)+walTransactionChecksumSize)
+	copy(data, encoded)
+	data = data[:len(encoded)+walTransactionChecksumSize]
+	binary.BigEndian.PutUint32(data[len(encoded):], walTransactionChecksum(txn.TransactionId, encoded))
+	if w.Cipher == nil {
+		return data, nil
+	}
+
+	sealed, err := sealBlock(
+		w.Cipher, append([]byte{}, data[:walTransactionFixedSize]...),
+		data[walTransactionFixedSize:], walTransactionAdditionalData(txn.TransactionId, data),
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"encrypting transaction %d for wal segment %d: %w", txn.TransactionId, w.SegmentId, err,
+		)
+	}
+
+	return sealed, nil
+}
+
+// decodeTransactionData will decrypt the data read from the segment if the segment has a cipher
+// and validate its checksum. The encoded transaction without the checksum is returned.
+func (w *walSegment) decodeTransactionData(transactionId uint64, data []byte) ([]byte, error) {
+	if w.Cipher != nil {
+		if len(data) < walTransactionFixedSize {
+			return nil, ErrDecrypting
+		}
+
+		plaintext, err := openBlock(
+			w.Cipher, nil, data[walTransactionFixedSize:],
+			walTransactionAdditionalData(transactionId, data),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(append([]byte{}, data[:walTransactionFixedSize]...), plaintext...)
+	}
+
+	if err := validateTransactionChecksum(transactionId, data); err != nil {
+		return nil, err
+	}
+
+	return data[:len(data)-walTransactionChecksumSize], nil
+}
+
+// walTransactionAdditionalData returns the data that is authenticated along with an encrypted
+// transaction. This is the transaction id and the timestamp of the transaction.
+func walTransactionAdditionalData(transactionId uint64, data []byte) []byte {
+	additionalData := make([]byte, 16)
+	binary.BigEndian.PutUint64(additionalData[0:8], transactionId)
+	copy(additionalData[8:16], data[0:8])
+	return additionalData
+}
+
+// walTransactionChecksum returns the checksum of the encoded transaction provided. The HeapId and
+// the ValueFileId are not included in the checksum because they are updated in place once the
+// transaction has been flushed. (see UpdateTransaction)
+func walTransactionChecksum(transactionId uint64, encoded []byte) uint32 {
+	h := fnv.New32()
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, transactionId)
+	_, _ = h.Write(id)
+	_, _ = h.Write(encoded[0:8])
+	_, _ = h.Write(encoded[24:])
+	return h.Sum32()
+}
+
+// validateTransactionChecksum will check the checksum that suffixes the transaction data provided.
+// If the data is too short to be a transaction, or the checksum does not match then
+// ErrBadTransactionChecksum is returned.
+func validateTransactionChecksum(transactionId uint64, data []byte) error {
+	// Every transaction is at least the 26 bytes of its fixed fields plus the checksum.
+	if len(data) < 26+walTransactionChecksumSize {
+		return ErrBadTransactionChecksum
+	}
+
+	size := len(data) - walTransactionChecksumSize
+	if walTransactionChecksum(transactionId, data[:size]) != binary.BigEndian.Uint32(data[size:]) {
+		return ErrBadTransactionChecksum
+	}
+
+	return nil
+}
+
 // Encode returns the binary representation of the walTransaction.
 // 1. 8 Bytes: Timestamp
 // 2. 8 Bytes: Heap ID
@@ -347,16 +1424,36 @@ func (t *walTransaction) Decode(src []byte) {
 // 1. 1 Byte: Change Type
 // 2. 4+ Bytes: Key
 // 3. 0-4+ Bytes: Value (If we are deleting then this is not included.
+// 4. 0-4+ Bytes: Value Location (Only included if the value has been written, this is indicated
+// by walTransactionChangeHasLocation being set in the change type.)
 func (c *walTransactionChange) Encode() []byte {
+	// The value is always kept in the WAL even once it has been written, this way the change can
+	// still be replayed if the value file is lost.
+	hasLocation := c.Type == walTransactionChangeTypeSet && c.ValueLocation.FileId > 0
+
 	buf := buffers.NewBytesBuffer()
-	buf.AppendByte(byte(c.Type))
+	if hasLocation {
+		buf.AppendByte(byte(c.Type) | walTransactionChangeHasLocation)
+	} else {
+		buf.AppendByte(byte(c.Type))
+	}
 	buf.Append(c.Key...)
 
 	switch c.Type {
 	// Right now only a set type will need the actual value. There might
 	// be others in the future that do or do not need the value stored.
 	case walTransactionChangeTypeSet:
-		buf.Append(c.Value...)
+		// A nil slice would be encoded as a missing value, a set always has a value even if it is
+		// empty.
+		value := c.Value
+		if value == nil {
+			value = []byte{}
+		}
+		buf.Append(value...)
+
+		if hasLocation {
+			buf.Append(c.ValueLocation.Encode()...)
+		}
 	}
 
 	return buf.Bytes()
@@ -364,11 +1461,20 @@ func (c *walTransactionChange) Encode() []byte {
 
 func (c *walTransactionChange) Decode(src []byte) {
 	buf := buffers.NewBytesReader(src)
-	c.Type = walTransactionChangeType(buf.NextByte())
+	changeType := buf.NextByte()
+	c.Type = walTransactionChangeType(changeType &^ walTransactionChangeHasLocation)
 	c.Key = buf.NextBytes()
 
 	switch c.Type {
 	case walTransactionChangeTypeSet:
 		c.Value = buf.NextBytes()
+
+		// The transaction has already been checksummed, so the location can only be bad if it
+		// was written wrong. It is dropped in that case and the value is written again instead.
+		if changeType&walTransactionChangeHasLocation != 0 {
+			if err := c.ValueLocation.Decode(buf.NextBytes()); err != nil {
+				c.ValueLocation = ValueLocator{}
+			}
+		}
 	}
 }
@@ -1,8 +1,17 @@
 package lsmtree
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestNewWalManager(t *testing.T) {
@@ -10,7 +19,7 @@ func TestNewWalManager(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		manager, err := newWalManager(dir+"/wal", 1024*8)
+		manager, err := newWalManager(dir+"/wal", 1024*8, 0, RetryPolicy{}, true)
 		assert.NoError(t, err)
 		assert.NotNil(t, manager)
 	})
@@ -18,16 +27,18 @@ func TestNewWalManager(t *testing.T) {
 
 func TestOpenWalSegment(t *testing.T) {
 	t.Run("directory doesnt exist", func(t *testing.T) {
-		file, err := openWalSegment("tmp", 1, 1024)
+		file, err := openWalSegment("tmp", 1, 1024, true)
 		assert.Error(t, err)
 		assert.Nil(t, file)
+		assert.True(t, errors.Is(err, ErrOpeningFile))
+		assert.True(t, errors.Is(err, os.ErrNotExist))
 	})
 
 	t.Run("create file", func(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openWalSegment(dir, 1, 1024)
+		file, err := openWalSegment(dir, 1, 1024, true)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 	})
@@ -38,7 +49,7 @@ func TestWalSegment_Append(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openWalSegment(dir, 1, 1024)
+		file, err := openWalSegment(dir, 1, 1024, true)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -63,6 +74,50 @@ func TestWalSegment_Append(t *testing.T) {
 		})
 		assert.NoError(t, err)
 	})
+
+	t.Run("empty values", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		err = file.Append(walTransaction{
+			TransactionId: 1,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: nil,
+				},
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key2"),
+					Value: []byte{},
+				},
+				{
+					Type: walTransactionChangeTypeDelete,
+					Key:  []byte("key3"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		transactions, err := file.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 1)
+
+		// Setting a key to an empty value must never look like the key was deleted.
+		entries := transactions[0].Entries
+		for _, change := range entries[:2] {
+			assert.Equal(t, walTransactionChangeTypeSet, change.Type)
+			assert.NotNil(t, change.Value)
+			assert.Empty(t, change.Value)
+		}
+		assert.Equal(t, walTransactionChangeTypeDelete, entries[2].Type)
+		assert.Nil(t, entries[2].Value)
+	})
 }
 
 func TestWalSegment_Sync(t *testing.T) {
@@ -70,7 +125,7 @@ func TestWalSegment_Sync(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openWalSegment(dir, 1, 1024)
+		file, err := openWalSegment(dir, 1, 1024, true)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -99,3 +154,797 @@ func TestWalSegment_Sync(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestWalSegment_Errors(t *testing.T) {
+	t.Run("insufficient space", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 32, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		err = file.Append(walTransaction{
+			TransactionId: 12345,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+			},
+		})
+		assert.True(t, errors.Is(err, ErrInsufficientSpace))
+	})
+
+	t.Run("closed file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+		assert.NoError(t, file.Close())
+
+		err = file.Append(walTransaction{
+			TransactionId: 12345,
+		})
+		assert.True(t, errors.Is(err, ErrWritingFile))
+		assert.True(t, errors.Is(err, os.ErrClosed))
+
+		err = file.Sync()
+		assert.True(t, errors.Is(err, ErrWritingFile))
+	})
+}
+
+func TestWalSegment_Retry(t *testing.T) {
+	t.Run("transient errors", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		faulty := newFaultyFile(file.File)
+		faulty.FailWrites(syscall.EAGAIN, syscall.EINTR)
+		file.File = faulty
+		file.Retry = RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Microsecond,
+		}
+
+		before := file.Space.Space()
+		txn := walTransaction{
+			TransactionId: 12345,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+			},
+		}
+		err = file.Append(txn)
+		assert.NoError(t, err)
+
+		// The header, the data and the free space should each have been written once, and the
+		// space should only have been allocated once.
+		assert.Equal(t, 3, faulty.Writes)
+		assert.Equal(t, before-16-int64(len(txn.Encode())+walTransactionChecksumSize), file.Space.Space())
+
+		transactions, err := file.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 1)
+		assert.Equal(t, txn.Entries, transactions[0].Entries)
+	})
+
+	t.Run("disk full", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		faulty := newFaultyFile(file.File)
+		file.File = faulty
+
+		txn := walTransaction{
+			TransactionId: 1,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+			},
+		}
+
+		// Fail the header the first time, then the data the second time. The space should be
+		// given back both times.
+		before := file.Space
+		for _, errs := range [][]error{{syscall.ENOSPC}, {nil, syscall.ENOSPC}} {
+			faulty.FailWrites(errs...)
+			err = file.Append(txn)
+			assert.True(t, errors.Is(err, ErrDiskFull))
+			assert.True(t, errors.Is(err, syscall.ENOSPC))
+			assert.Equal(t, before, file.Space)
+		}
+
+		assert.NoError(t, file.Append(txn))
+
+		transactions, err := file.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 1)
+		assert.Equal(t, txn.Entries, transactions[0].Entries)
+	})
+}
+
+func TestWalManager_Prealloc(t *testing.T) {
+	t.Run("grows before rotating", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 1024, 256, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+
+		sizes := make([]int64, 0)
+		transactionId := uint64(1)
+		for ; manager.currentSegment == nil || manager.currentSegment.SegmentId == 1; transactionId++ {
+			err = manager.Append(walTransaction{
+				TransactionId: transactionId,
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key"),
+						Value: []byte("value"),
+					},
+				},
+			})
+			assert.NoError(t, err)
+
+			if manager.currentSegment.SegmentId == 1 {
+				if size := manager.currentSegment.Size; len(sizes) == 0 || sizes[len(sizes)-1] != size {
+					sizes = append(sizes, size)
+				}
+			}
+		}
+
+		// The first segment should have started at the prealloc size and grown until it reached
+		// the max size before the second segment was started.
+		assert.Equal(t, []int64{256, 512, 1024}, sizes)
+		assert.Equal(t, int64(256), manager.currentSegment.Size)
+		assert.NoError(t, manager.Close())
+
+		// Every transaction should still be readable in order after the segment was grown.
+		expected := uint64(1)
+		err = manager.iterate(func(txn walTransaction) error {
+			assert.Equal(t, expected, txn.TransactionId)
+			assert.Equal(t, Key("key"), txn.Entries[0].Key)
+			assert.Equal(t, []byte("value"), txn.Entries[0].Value)
+			expected++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, transactionId, expected)
+	})
+
+	t.Run("grows for a transaction larger than the prealloc size", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 4096, 256, RetryPolicy{}, true)
+		assert.NoError(t, err)
+
+		// Each transaction is larger than a new segment but several fit in a segment of the max
+		// size. That should still be the case for the segments started after the first one is
+		// full.
+		numberOfTransactions := 12
+		value := bytes.Repeat([]byte("a"), 512)
+		for transactionId := 1; transactionId <= numberOfTransactions; transactionId++ {
+			assert.NoError(t, manager.Append(walTransaction{
+				TransactionId: uint64(transactionId),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key"),
+						Value: value,
+					},
+				},
+			}))
+			if assert.NotNil(t, manager.currentSegment) {
+				assert.LessOrEqual(t, manager.currentSegment.Size, int64(4096))
+			}
+		}
+		assert.NoError(t, manager.Close())
+
+		segmentIds, err := getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+		assert.Less(t, len(segmentIds), numberOfTransactions/2)
+
+		total := 0
+		for _, segmentId := range segmentIds {
+			transactions, err := manager.getSegmentTransactions(segmentId)
+			assert.NoError(t, err)
+			assert.Greater(t, len(transactions), 1, "segment %d", segmentId)
+			total += len(transactions)
+		}
+		assert.Equal(t, numberOfTransactions, total)
+	})
+
+	t.Run("defaults to the max size", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 1024, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1024), manager.PreallocSize)
+	})
+}
+
+func TestWalManager_ShouldRotate(t *testing.T) {
+	newTransaction := func(transactionId uint64) walTransaction {
+		return walTransaction{
+			TransactionId: transactionId,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: []byte("value"),
+				},
+			},
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 1024, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+
+		used, capacity := manager.CurrentSegmentSize()
+		assert.Equal(t, int64(0), used)
+		assert.Equal(t, int64(0), capacity)
+
+		txn := newTransaction(1)
+		err = manager.Append(txn)
+		assert.NoError(t, err)
+
+		used, capacity = manager.CurrentSegmentSize()
+		assert.Equal(t, int64(8+walTransactionHeaderSize+len(txn.Encode())+walTransactionChecksumSize), used)
+		assert.Equal(t, int64(1024), capacity)
+
+		// Without a hook the segment should only rotate when it is full.
+		for i := uint64(2); i <= 10; i++ {
+			assert.NoError(t, manager.Append(newTransaction(i)))
+		}
+		assert.Equal(t, uint64(1), manager.currentSegment.SegmentId)
+		assert.NoError(t, manager.Close())
+	})
+
+	t.Run("rotate after a number of transactions", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 1024, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+
+		transactions := 0
+		manager.ShouldRotate = func(used, capacity int64) bool {
+			transactions++
+			return transactions%3 == 0
+		}
+
+		for i := uint64(1); i <= 9; i++ {
+			assert.NoError(t, manager.Append(newTransaction(i)))
+		}
+		assert.NoError(t, manager.Close())
+
+		segmentIds, err := getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2, 3}, segmentIds)
+
+		for _, segmentId := range segmentIds {
+			segment, err := openWalSegment(dir, segmentId, 1024, false)
+			assert.NoError(t, err)
+			transactions, err := segment.GetTransactions()
+			assert.NoError(t, err)
+			assert.Len(t, transactions, 3)
+			assert.Equal(t, (segmentId-1)*3+1, transactions[0].TransactionId)
+			assert.NoError(t, segment.Close())
+		}
+	})
+}
+
+func TestWalManager_OversizedTransaction(t *testing.T) {
+	transaction := func(transactionId uint64, value []byte) walTransaction {
+		return walTransaction{
+			TransactionId: transactionId,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: value,
+				},
+			},
+		}
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted %t", encrypted), func(t *testing.T) {
+			dir, cleanup := NewTempDirectory(t)
+			defer cleanup()
+
+			manager, err := newWalManager(dir, 1024, 256, RetryPolicy{}, true)
+			assert.NoError(t, err)
+			if encrypted {
+				manager.Cipher = newTestCipher(t, "secret")
+			}
+
+			large := bytes.Repeat([]byte("a"), 4096)
+			assert.NoError(t, manager.Append(transaction(1, []byte("small"))))
+			assert.NoError(t, manager.Append(transaction(2, large)))
+
+			// The large transaction should be in a segment of its own that has already been
+			// finished, so the next transaction starts another segment.
+			assert.Nil(t, manager.currentSegment)
+			assert.NoError(t, manager.Append(transaction(3, []byte("small"))))
+			assert.Equal(t, uint64(3), manager.currentSegment.SegmentId)
+			assert.NoError(t, manager.Close())
+
+			info, err := os.Stat(path.Join(dir, getWalSegmentFileName(2)))
+			assert.NoError(t, err)
+			assert.Greater(t, info.Size(), int64(len(large)))
+
+			// Every transaction should still be there once the WAL is reopened.
+			manager, err = newWalManager(dir, 1024, 256, RetryPolicy{}, true)
+			assert.NoError(t, err)
+			if encrypted {
+				manager.Cipher = newTestCipher(t, "secret")
+			}
+
+			itr, err := manager.ReadFrom(0)
+			assert.NoError(t, err)
+
+			expected := []walTransaction{
+				transaction(1, []byte("small")), transaction(2, large), transaction(3, []byte("small")),
+			}
+			for _, txn := range expected {
+				if assert.True(t, itr.Valid()) {
+					assert.Equal(t, txn.TransactionId, itr.Transaction().TransactionId)
+					assert.Equal(t, txn.Entries[0].Value, itr.Transaction().Entries[0].Value)
+				}
+				itr.Next()
+			}
+			assert.False(t, itr.Valid())
+			assert.NoError(t, itr.Err())
+			assert.NoError(t, manager.Close())
+		})
+	}
+}
+
+func TestWalSegment_Recover(t *testing.T) {
+	newTransaction := func(transactionId uint64) walTransaction {
+		return walTransaction{
+			TransactionId: transactionId,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: []byte("value"),
+				},
+			},
+		}
+	}
+
+	transactionIds := func(t *testing.T, segment *walSegment) []uint64 {
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		ids := make([]uint64, len(transactions))
+		for i, transaction := range transactions {
+			ids[i] = transaction.TransactionId
+		}
+		return ids
+	}
+
+	t.Run("torn last transaction", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+
+		assert.NoError(t, segment.Append(newTransaction(1)))
+		validSpace := segment.Space
+		assert.NoError(t, segment.Append(newTransaction(2)))
+		assert.NoError(t, segment.Sync())
+
+		// Simulate a crash part way through writing the data of the second transaction.
+		ok, start, end, err := segment.getTransactionDataLocation(2)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		_, err = segment.File.WriteAt(make([]byte, (end-start)/2), start+(end-start)/2)
+		assert.NoError(t, err)
+		assert.NoError(t, segment.Close())
+
+		segment, err = openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.Equal(t, validSpace, segment.Space)
+		assert.Equal(t, []uint64{1}, transactionIds(t, segment))
+
+		// New transactions should be appended after the last valid transaction.
+		assert.NoError(t, segment.Append(newTransaction(3)))
+		assert.Equal(t, []uint64{1, 3}, transactionIds(t, segment))
+		assert.NoError(t, segment.Sync())
+		assert.NoError(t, segment.Close())
+
+		segment, err = openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 3}, transactionIds(t, segment))
+		assert.NoError(t, segment.Close())
+	})
+
+	t.Run("not synced", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+
+		assert.NoError(t, segment.Append(newTransaction(1)))
+		assert.NoError(t, segment.Sync())
+		assert.NoError(t, segment.Append(newTransaction(2)))
+		space := segment.Space
+		assert.NoError(t, segment.Close())
+
+		// The second transaction was completely written even though the free space was not.
+		segment, err = openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.Equal(t, space, segment.Space)
+		assert.Equal(t, []uint64{1, 2}, transactionIds(t, segment))
+		assert.NoError(t, segment.Close())
+	})
+
+	t.Run("interrupted grow", func(t *testing.T) {
+		// Each of these is a point that Grow could be interrupted at once the file has been
+		// truncated to its new size, before all of the headers point to the new copy of the data.
+		stages := map[string]struct {
+			copied    bool
+			rewritten []uint64
+		}{
+			"truncated":              {},
+			"copied":                 {copied: true},
+			"first header rewritten": {copied: true, rewritten: []uint64{1}},
+			"last header rewritten":  {copied: true, rewritten: []uint64{3}},
+		}
+
+		for name, stage := range stages {
+			t.Run(name, func(t *testing.T) {
+				dir, cleanup := NewTempDirectory(t)
+				defer cleanup()
+
+				segment, err := openWalSegment(dir, 1, 1024, true)
+				assert.NoError(t, err)
+				for i := uint64(1); i <= 3; i++ {
+					assert.NoError(t, segment.Append(newTransaction(i)))
+				}
+				assert.NoError(t, segment.Sync())
+				headerOffset, dataOffset := segment.Space.Current()
+
+				locations := map[uint64][2]int64{}
+				for i := uint64(1); i <= 3; i++ {
+					ok, start, end, err := segment.getTransactionDataLocation(i)
+					assert.NoError(t, err)
+					assert.True(t, ok)
+					locations[i] = [2]int64{start, end}
+				}
+				assert.NoError(t, segment.Close())
+
+				// Do the parts of Grow that made it to the disk before the crash.
+				file, err := os.OpenFile(path.Join(dir, getWalSegmentFileName(1)), os.O_RDWR, 0)
+				assert.NoError(t, err)
+				assert.NoError(t, file.Truncate(2048))
+				if stage.copied {
+					data := make([]byte, 1024-dataOffset)
+					_, err = file.ReadAt(data, dataOffset)
+					assert.NoError(t, err)
+					_, err = file.WriteAt(data, dataOffset+1024)
+					assert.NoError(t, err)
+				}
+				for _, transactionId := range stage.rewritten {
+					header := make([]byte, walTransactionHeaderSize)
+					binary.BigEndian.PutUint64(header[0:8], transactionId)
+					binary.BigEndian.PutUint32(header[8:12], uint32(locations[transactionId][0]+1024))
+					binary.BigEndian.PutUint32(header[12:16], uint32(locations[transactionId][1]+1024))
+					_, err = file.WriteAt(header, 8+int64(transactionId-1)*walTransactionHeaderSize)
+					assert.NoError(t, err)
+				}
+				assert.NoError(t, file.Close())
+
+				// Every transaction should still be there, and the grow should have been finished.
+				segment, err = openWalSegment(dir, 1, 1024, true)
+				assert.NoError(t, err)
+				assert.Equal(t, []uint64{1, 2, 3}, transactionIds(t, segment))
+				assert.Equal(t, newFreeSpaceFromOffsets(headerOffset, dataOffset+1024), segment.Space)
+				for i := uint64(1); i <= 3; i++ {
+					ok, start, end, err := segment.getTransactionDataLocation(i)
+					assert.NoError(t, err)
+					assert.True(t, ok)
+					assert.Equal(t, locations[i][0]+1024, start)
+					assert.Equal(t, locations[i][1]+1024, end)
+				}
+
+				assert.NoError(t, segment.Append(newTransaction(4)))
+				assert.NoError(t, segment.Sync())
+				assert.NoError(t, segment.Close())
+
+				segment, err = openWalSegment(dir, 1, 1024, true)
+				assert.NoError(t, err)
+				assert.Equal(t, []uint64{1, 2, 3, 4}, transactionIds(t, segment))
+				assert.NoError(t, segment.Close())
+			})
+		}
+	})
+}
+
+func TestWalSegment_Reopen(t *testing.T) {
+	t.Run("append after reopen", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+
+		numberOfTransactions := 5
+		for i := 1; i <= numberOfTransactions; i++ {
+			err = segment.Append(walTransaction{
+				TransactionId: uint64(i),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key%d", i)),
+						Value: []byte(fmt.Sprintf("value%d", i)),
+					},
+				},
+			})
+			assert.NoError(t, err)
+		}
+		space := segment.Space
+
+		// Close the segment without syncing it, the free space should still be in the file.
+		assert.NoError(t, segment.Close())
+
+		stored, err := ioutil.ReadFile(path.Join(dir, getWalSegmentFileName(1)))
+		assert.NoError(t, err)
+		assert.Equal(t, space, newFreeSpaceFromBytes(stored[:8]))
+
+		segment, err = openWalSegment(dir, 1, 1024, true)
+		assert.NoError(t, err)
+		assert.Equal(t, space, segment.Space)
+
+		err = segment.Append(walTransaction{
+			TransactionId: uint64(numberOfTransactions + 1),
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key6"),
+					Value: []byte("value6"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		// None of the existing transactions should have been overwritten.
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, numberOfTransactions+1)
+		for i, transaction := range transactions {
+			assert.Equal(t, uint64(i+1), transaction.TransactionId)
+			assert.Equal(t, []byte(fmt.Sprintf("key%d", i+1)), []byte(transaction.Entries[0].Key))
+			assert.Equal(t, []byte(fmt.Sprintf("value%d", i+1)), transaction.Entries[0].Value)
+		}
+		assert.NoError(t, segment.Close())
+	})
+}
+
+func TestWalManager_ReadFrom(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	manager, err := newWalManager(dir, 256, 0, RetryPolicy{}, true)
+	assert.NoError(t, err)
+
+	// Only even transaction ids are written so that there are gaps between them, and the segments
+	// are small enough that the transactions span several segments.
+	numberOfTransactions := 40
+	for i := 1; i <= numberOfTransactions; i++ {
+		err = manager.Append(walTransaction{
+			TransactionId: uint64(i * 2),
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte(fmt.Sprintf("key%d", i)),
+					Value: []byte("value"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	segmentIds, err := getFileIds(dir, FileTypeWAL)
+	assert.NoError(t, err)
+	assert.Greater(t, len(segmentIds), 2)
+
+	readFrom := func(t *testing.T, transactionId uint64) []uint64 {
+		itr, err := manager.ReadFrom(transactionId)
+		assert.NoError(t, err)
+
+		ids := make([]uint64, 0)
+		for ; itr.Valid(); itr.Next() {
+			ids = append(ids, itr.Transaction().TransactionId)
+		}
+		assert.NoError(t, itr.Err())
+
+		return ids
+	}
+
+	expected := func(from int) []uint64 {
+		ids := make([]uint64, 0)
+		for i := from; i <= numberOfTransactions; i++ {
+			ids = append(ids, uint64(i*2))
+		}
+		return ids
+	}
+
+	t.Run("beginning", func(t *testing.T) {
+		assert.Equal(t, expected(1), readFrom(t, 0))
+		assert.Equal(t, expected(1), readFrom(t, 2))
+	})
+
+	t.Run("middle", func(t *testing.T) {
+		assert.Equal(t, expected(20), readFrom(t, 40))
+	})
+
+	t.Run("between transactions", func(t *testing.T) {
+		assert.Equal(t, expected(21), readFrom(t, 41))
+	})
+
+	t.Run("past the end", func(t *testing.T) {
+		assert.Empty(t, readFrom(t, uint64(numberOfTransactions*2+1)))
+	})
+
+	assert.NoError(t, manager.Close())
+}
+
+func TestWalManager_LastTransactionId(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 256, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		defer manager.Close()
+
+		_, ok, err := manager.LastTransactionId()
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("after reopen", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 256, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+
+		for i := uint64(1); i <= 20; i++ {
+			assert.NoError(t, manager.Append(walTransaction{
+				TransactionId: i,
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key%d", i)),
+						Value: []byte("value"),
+					},
+				},
+			}))
+		}
+		assert.NoError(t, manager.Close())
+
+		segmentIds, err := getFileIds(dir, FileTypeWAL)
+		assert.NoError(t, err)
+		assert.Greater(t, len(segmentIds), 1)
+
+		manager, err = newWalManager(dir, 256, 0, RetryPolicy{}, true)
+		assert.NoError(t, err)
+		defer manager.Close()
+
+		transactionId, ok, err := manager.LastTransactionId()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(20), transactionId)
+
+		lastTransaction, ok, err := manager.LastTransaction()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, transactionId, lastTransaction.TransactionId)
+	})
+}
+
+func TestWalSegment_Index(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	segment, err := openWalSegment(dir, 1, 1024*8, true)
+	assert.NoError(t, err)
+
+	numberOfTransactions := 100
+	for i := 1; i <= numberOfTransactions; i++ {
+		err = segment.Append(walTransaction{
+			TransactionId: uint64(i),
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: []byte("value"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	// locate will find the transaction and return how many bytes were read to find it.
+	locate := func(t *testing.T, segment *walSegment, transactionId uint64) (bool, int) {
+		faulty := newFaultyFile(segment.File)
+		file := segment.File
+		segment.File = faulty
+		defer func() {
+			segment.File = file
+		}()
+
+		ok, start, end, err := segment.getTransactionDataLocation(transactionId)
+		assert.NoError(t, err)
+		if ok {
+			assert.Greater(t, end, start)
+		}
+
+		return ok, faulty.BytesRead
+	}
+
+	t.Run("only reads one header", func(t *testing.T) {
+		ok, bytesRead := locate(t, segment, uint64(numberOfTransactions))
+		assert.True(t, ok)
+		assert.Equal(t, walTransactionHeaderSize, bytesRead)
+
+		ok, bytesRead = locate(t, segment, uint64(numberOfTransactions+1))
+		assert.False(t, ok)
+		assert.Equal(t, 0, bytesRead)
+	})
+
+	t.Run("after reopen", func(t *testing.T) {
+		assert.NoError(t, segment.Close())
+
+		segment, err = openWalSegment(dir, 1, 1024*8, true)
+		assert.NoError(t, err)
+		defer segment.Close()
+
+		for _, transactionId := range []uint64{1, 50, uint64(numberOfTransactions)} {
+			ok, bytesRead := locate(t, segment, transactionId)
+			assert.True(t, ok)
+			assert.Equal(t, walTransactionHeaderSize, bytesRead)
+		}
+
+		ok, err := segment.UpdateTransaction(50, 7, 8)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, numberOfTransactions)
+		assert.Equal(t, uint64(7), transactions[49].HeapId)
+		assert.Equal(t, uint64(8), transactions[49].ValueFileId)
+	})
+}